@@ -0,0 +1,299 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const defaultRecentSessions = 50
+
+// trackerStats records what a tracker has been doing, so it
+// can be reported by the admin API. The most recently parsed
+// sessions are kept in a ring buffer for debugging.
+type trackerStats struct {
+	mu              sync.Mutex
+	requests        int64
+	skipped         int64
+	sessionsParsed  int64
+	parseQuality    parseReport
+	dupUploads      int64
+	dupSessions     int64
+	overloadDrops   int64
+	inFlightUploads int64
+	lastUploadTime  time.Time
+	lastUploadState string
+	lastUploadError string
+	recent          []logSession
+	next            int
+}
+
+func newTrackerStats(recentCount int) *trackerStats {
+	if recentCount <= 0 {
+		recentCount = defaultRecentSessions
+	}
+	return &trackerStats{recent: make([]logSession, 0, recentCount)}
+}
+
+// recordParse accumulates the quality report of a parsed request.
+func (s *trackerStats) recordParse(report parseReport) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.parseQuality.add(report)
+}
+
+// recordRequest notes an incoming request and the sessions parsed
+// from it (not counting duplicates of sessions already emitted).
+func (s *trackerStats) recordRequest(sessions []logSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	s.sessionsParsed += int64(len(sessions))
+	for _, session := range sessions {
+		if len(s.recent) < cap(s.recent) {
+			s.recent = append(s.recent, session)
+		} else {
+			s.recent[s.next] = session
+		}
+		s.next = (s.next + 1) % cap(s.recent)
+	}
+}
+
+// recordDuplicates notes an upload that duplicated an earlier one,
+// or the number of its sessions that did.
+func (s *trackerStats) recordDuplicates(upload bool, sessions int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if upload {
+		s.dupUploads++
+	}
+	s.dupSessions += int64(sessions)
+}
+
+// recordSkip notes an incoming request that wasn't parsed
+// because the tracker's filter rejected it.
+func (s *trackerStats) recordSkip() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.skipped++
+}
+
+// recordOverload notes an upload (of sessions, a rollup update,
+// or version alerts) dropped because too many were in progress.
+func (s *trackerStats) recordOverload() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.overloadDrops++
+}
+
+// startUpload notes that an upload has begun.
+func (s *trackerStats) startUpload() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inFlightUploads++
+}
+
+// finishUpload notes the outcome of an upload.
+func (s *trackerStats) finishUpload(state string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inFlightUploads--
+	s.lastUploadTime = time.Now()
+	s.lastUploadState = state
+	s.lastUploadError = ""
+	if err != nil {
+		s.lastUploadError = err.Error()
+	}
+}
+
+// recentSessions returns the buffered sessions, oldest first.
+func (s *trackerStats) recentSessions() []logSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.recent) < cap(s.recent) {
+		return append([]logSession(nil), s.recent...)
+	}
+	return append(append([]logSession(nil), s.recent[s.next:]...), s.recent[:s.next]...)
+}
+
+type statsReport struct {
+	Requests        int64       `json:"requests"`
+	SkippedRequests int64       `json:"skippedRequests"`
+	SessionsParsed  int64       `json:"sessionsParsed"`
+	ParseQuality    parseReport `json:"parseQuality"`
+	DupUploads      int64       `json:"duplicateUploads,omitempty"`
+	DupSessions     int64       `json:"duplicateSessions,omitempty"`
+	DroppedUploads  int64       `json:"droppedUploads,omitempty"`
+	InFlightUploads int64       `json:"inFlightUploads"`
+	LastUploadTime  *time.Time  `json:"lastUploadTime,omitempty"`
+	LastUploadState string      `json:"lastUploadStatus,omitempty"`
+	LastUploadError string      `json:"lastUploadError,omitempty"`
+	BreakerState    string      `json:"breakerState,omitempty"`
+}
+
+func (s *trackerStats) report() statsReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := statsReport{
+		Requests:        s.requests,
+		SkippedRequests: s.skipped,
+		SessionsParsed:  s.sessionsParsed,
+		ParseQuality:    s.parseQuality,
+		DupUploads:      s.dupUploads,
+		DupSessions:     s.dupSessions,
+		DroppedUploads:  s.overloadDrops,
+		InFlightUploads: s.inFlightUploads,
+		LastUploadState: s.lastUploadState,
+		LastUploadError: s.lastUploadError,
+	}
+	if !s.lastUploadTime.IsZero() {
+		t := s.lastUploadTime
+		r.LastUploadTime = &t
+	}
+	return r
+}
+
+// The tracker registry holds every provisioned tracker, so the
+// admin API (which is a separate module) can report on them.
+var (
+	registryMu sync.Mutex
+	registry   = map[int]*AdobeUsageTracker{}
+	registryID int
+)
+
+// registerTracker adds a tracker to the registry and returns its id.
+func registerTracker(m *AdobeUsageTracker) int {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registryID++
+	registry[registryID] = m
+	return registryID
+}
+
+// unregisterTracker removes a tracker from the registry.
+func unregisterTracker(id int) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	delete(registry, id)
+}
+
+// registeredTrackers returns the registered trackers by id.
+func registeredTrackers() map[int]*AdobeUsageTracker {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	result := make(map[int]*AdobeUsageTracker, len(registry))
+	for id, m := range registry {
+		result[id] = m
+	}
+	return result
+}
+
+// trackerAdmin is a Caddy admin module that serves JSON reports
+// on the running trackers under /adobe-usage-tracker/:
+//
+// - /adobe-usage-tracker/status reports each tracker's
+// configuration (with its token redacted) and statistics.
+// - /adobe-usage-tracker/sessions reports each tracker's
+// most recently parsed sessions.
+// - /adobe-usage-tracker/report reports license utilization
+// from the trackers' session stores.
+type trackerAdmin struct{}
+
+// CaddyModule returns the Caddy module information.
+func (trackerAdmin) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.adobe_usage_tracker",
+		New: func() caddy.Module { return new(trackerAdmin) },
+	}
+}
+
+// Routes implements caddy.AdminRouter.
+func (a trackerAdmin) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{Pattern: "/adobe-usage-tracker/status", Handler: caddy.AdminHandlerFunc(a.handleStatus)},
+		{Pattern: "/adobe-usage-tracker/sessions", Handler: caddy.AdminHandlerFunc(a.handleSessions)},
+		{Pattern: "/adobe-usage-tracker/report", Handler: caddy.AdminHandlerFunc(a.handleReport)},
+	}
+}
+
+type trackerStatus struct {
+	ID     int               `json:"id"`
+	Config AdobeUsageTracker `json:"config"`
+	Stats  statsReport       `json:"stats"`
+}
+
+func (trackerAdmin) handleStatus(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+	}
+	var result struct {
+		Trackers []trackerStatus `json:"trackers"`
+	}
+	result.Trackers = []trackerStatus{}
+	trackers := registeredTrackers()
+	for _, id := range sortedIDs(trackers) {
+		m := trackers[id]
+		status := trackerStatus{ID: id, Config: m.redacted(), Stats: m.stats.report()}
+		if b, ok := m.sink.(*circuitBreaker); ok {
+			status.Stats.BreakerState = b.currentState().String()
+		}
+		result.Trackers = append(result.Trackers, status)
+	}
+	return writeJSON(w, result)
+}
+
+type trackerSessions struct {
+	ID       int          `json:"id"`
+	Sessions []logSession `json:"sessions"`
+}
+
+func (trackerAdmin) handleSessions(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+	}
+	var result struct {
+		Trackers []trackerSessions `json:"trackers"`
+	}
+	result.Trackers = []trackerSessions{}
+	trackers := registeredTrackers()
+	for _, id := range sortedIDs(trackers) {
+		result.Trackers = append(result.Trackers, trackerSessions{ID: id, Sessions: trackers[id].stats.recentSessions()})
+	}
+	return writeJSON(w, result)
+}
+
+// sortedIDs returns the ids of the given trackers in order.
+func sortedIDs(trackers map[int]*AdobeUsageTracker) []int {
+	ids := make([]int, 0, len(trackers))
+	for id := range trackers {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func writeJSON(w http.ResponseWriter, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*trackerAdmin)(nil)
+)
@@ -0,0 +1,94 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRecentSessionsRing(t *testing.T) {
+	stats := newTrackerStats(3)
+	for i := 1; i <= 5; i++ {
+		stats.recordRequest([]logSession{{sessionId: fmt.Sprintf("s%d", i)}})
+	}
+	recent := stats.recentSessions()
+	if len(recent) != 3 || recent[0].sessionId != "s3" || recent[2].sessionId != "s5" {
+		t.Errorf("Expected sessions s3..s5, got %v", recent)
+	}
+	if r := stats.report(); r.Requests != 5 || r.SessionsParsed != 5 {
+		t.Errorf("Expected 5 requests and sessions, got %+v", r)
+	}
+}
+
+func TestAdminStatusAndSessions(t *testing.T) {
+	m := &AdobeUsageTracker{
+		Endpoint: "https://influx.example.com",
+		Database: "db",
+		Policy:   "autogen",
+		Token:    "super-secret-token",
+		Position: "first",
+	}
+	if err := m.Provision(caddy.Context{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	defer func() { _ = m.Cleanup() }()
+	m.stats.recordRequest([]logSession{{sessionId: "admin-test-session", appId: "Photoshop1"}})
+	m.stats.startUpload()
+
+	var admin trackerAdmin
+	rec := httptest.NewRecorder()
+	if err := admin.handleStatus(rec, httptest.NewRequest(http.MethodGet, "/adobe-usage-tracker/status", nil)); err != nil {
+		t.Fatalf("handleStatus failed: %v", err)
+	}
+	if strings.Contains(rec.Body.String(), "super-secret-token") {
+		t.Errorf("Status report contains unredacted token: %s", rec.Body.String())
+	}
+	var status struct {
+		Trackers []struct {
+			ID     int            `json:"id"`
+			Config map[string]any `json:"config"`
+			Stats  statsReport    `json:"stats"`
+		} `json:"trackers"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Invalid status JSON: %v", err)
+	}
+	found := false
+	for _, tr := range status.Trackers {
+		if tr.ID == m.id {
+			found = true
+			if tr.Config["token"] != "REDACTED" || tr.Config["database"] != "db" {
+				t.Errorf("Unexpected config in status: %v", tr.Config)
+			}
+			if tr.Stats.InFlightUploads != 1 || tr.Stats.SessionsParsed != 1 || tr.Stats.BreakerState != "closed" {
+				t.Errorf("Unexpected stats in status: %+v", tr.Stats)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("Tracker %d missing from status: %s", m.id, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	if err := admin.handleSessions(rec, httptest.NewRequest(http.MethodGet, "/adobe-usage-tracker/sessions", nil)); err != nil {
+		t.Fatalf("handleSessions failed: %v", err)
+	}
+	if !strings.Contains(rec.Body.String(), `"sessionId": "admin-test-session"`) {
+		t.Errorf("Recent session missing from report: %s", rec.Body.String())
+	}
+
+	err := admin.handleStatus(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/adobe-usage-tracker/status", nil))
+	if apiErr, ok := err.(caddy.APIError); !ok || apiErr.HTTPStatus != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for POST, got %v", err)
+	}
+}
@@ -0,0 +1,355 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"sort"
+	"strconv"
+)
+
+// UsageApp is the adobe_usage Caddy app. It holds named upload
+// pipelines, so that the adobe_usage_tracker handlers in several
+// sites can share one: the handlers name the pipeline instead of
+// giving their own Influx settings.
+//
+// Each pipeline owns its upload client (including the state of its
+// circuit breaker), its limit on uploads in progress, and its dedupe
+// cache. Pipelines are shared across config reloads as long as
+// their configuration doesn't change, so a reload doesn't lose that
+// state, and uploads in progress (including their retries) are not
+// dropped.
+type UsageApp struct {
+	Pipelines map[string]*Pipeline `json:"pipelines,omitempty"`
+
+	pipelines map[string]*pipeline
+	keys      []string
+}
+
+// A Pipeline configures where the sessions parsed by the trackers
+// using it are uploaded. Its settings have the same names and
+// meanings as those of an AdobeUsageTracker.
+type Pipeline struct {
+	Endpoint  string `json:"endpoint,omitempty"`
+	Database  string `json:"database,omitempty"`
+	Policy    string `json:"policy,omitempty"`
+	Token     string `json:"token,omitempty"`
+	TokenFile string `json:"token_file,omitempty"`
+
+	MaxRetryTime     caddy.Duration `json:"max_retry_time,omitempty"`
+	BreakerThreshold int            `json:"breaker_threshold,omitempty"`
+	BreakerCooldown  caddy.Duration `json:"breaker_cooldown,omitempty"`
+	MaxUploads       int            `json:"max_uploads,omitempty"`
+	VerifyOnStart    bool           `json:"verify_on_start,omitempty"`
+
+	DryRun     bool   `json:"dry_run,omitempty"`
+	DryRunFile string `json:"dry_run_file,omitempty"`
+
+	Dedupe     int    `json:"dedupe,omitempty"`
+	DedupeFile string `json:"dedupe_file,omitempty"`
+}
+
+// A pipeline is a provisioned Pipeline. Its output is set up
+// by a tracker that has only the pipeline's settings.
+type pipeline struct {
+	output *AdobeUsageTracker
+}
+
+// Pipelines with the same name and configuration are shared.
+var pipelines = caddy.NewUsagePool()
+
+// loadPipeline returns the shared pipeline with the given name
+// and configuration, creating it if necessary. Each call must be
+// matched by a call to releasePipeline with the returned key.
+func loadPipeline(name string, p *Pipeline) (*pipeline, string, error) {
+	config, err := json.Marshal(p)
+	if err != nil {
+		return nil, "", err
+	}
+	key := name + "|" + string(config)
+	value, _, err := pipelines.LoadOrNew(key, func() (caddy.Destructor, error) {
+		output := p.tracker(name)
+		if err := output.provisionOutput(); err != nil {
+			return nil, errors.Join(err, output.releaseOutput())
+		}
+		return &pipeline{output: output}, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return value.(*pipeline), key, nil
+}
+
+func releasePipeline(key string) error {
+	_, err := pipelines.Delete(key)
+	return err
+}
+
+// Destruct implements caddy.Destructor.
+func (p *pipeline) Destruct() error {
+	return p.output.releaseOutput()
+}
+
+// tracker returns a tracker with the pipeline's settings, which
+// is used to provision the pipeline's output.
+func (p *Pipeline) tracker(name string) *AdobeUsageTracker {
+	return &AdobeUsageTracker{
+		Endpoint:         p.Endpoint,
+		Database:         p.Database,
+		Policy:           p.Policy,
+		Token:            p.Token,
+		TokenFile:        p.TokenFile,
+		MaxRetryTime:     p.MaxRetryTime,
+		BreakerThreshold: p.BreakerThreshold,
+		BreakerCooldown:  p.BreakerCooldown,
+		MaxUploads:       p.MaxUploads,
+		VerifyOnStart:    p.VerifyOnStart,
+		DryRun:           p.DryRun,
+		DryRunFile:       p.DryRunFile,
+		Dedupe:           p.Dedupe,
+		DedupeFile:       p.DedupeFile,
+		Pipeline:         name,
+	}
+}
+
+// CaddyModule returns the Caddy module information.
+func (UsageApp) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "adobe_usage",
+		New: func() caddy.Module { return new(UsageApp) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (a *UsageApp) Provision(caddy.Context) error {
+	a.pipelines = make(map[string]*pipeline)
+	names := make([]string, 0, len(a.Pipelines))
+	for name := range a.Pipelines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if a.Pipelines[name] == nil {
+			return errors.Join(fmt.Errorf("pipeline %s has no configuration", name), a.Cleanup())
+		}
+		p, key, err := loadPipeline(name, a.Pipelines[name])
+		if err != nil {
+			return errors.Join(fmt.Errorf("pipeline %s: %v", name, err), a.Cleanup())
+		}
+		a.pipelines[name] = p
+		a.keys = append(a.keys, key)
+	}
+	return nil
+}
+
+// Start implements caddy.App.
+func (a *UsageApp) Start() error {
+	return nil
+}
+
+// Stop implements caddy.App. Uploads in progress are not
+// interrupted, since the next config may share their pipeline.
+func (a *UsageApp) Stop() error {
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper.
+func (a *UsageApp) Cleanup() error {
+	var errs []error
+	for _, key := range a.keys {
+		errs = append(errs, releasePipeline(key))
+	}
+	a.keys = nil
+	return errors.Join(errs...)
+}
+
+// attachPipeline makes the tracker upload via the pipeline it
+// names, which must be configured in the adobe_usage app. The
+// tracker can't have any pipeline settings of its own.
+func (m *AdobeUsageTracker) attachPipeline(ctx caddy.Context) error {
+	for _, own := range []struct {
+		setting string
+		isSet   bool
+	}{
+		{"endpoint", m.Endpoint != ""},
+		{"database", m.Database != ""},
+		{"policy", m.Policy != ""},
+		{"token", m.Token != ""},
+		{"token_file", m.TokenFile != ""},
+		{"max_retry_time", m.MaxRetryTime != 0},
+		{"breaker_threshold", m.BreakerThreshold != 0},
+		{"breaker_cooldown", m.BreakerCooldown != 0},
+		{"max_uploads", m.MaxUploads != 0},
+		{"verify_on_start", m.VerifyOnStart},
+		{"dry_run", m.DryRun},
+		{"dry_run_file", m.DryRunFile != ""},
+		{"dedupe", m.Dedupe != 0},
+		{"dedupe_file", m.DedupeFile != ""},
+	} {
+		if own.isSet {
+			return fmt.Errorf("%s cannot be used with a pipeline (configure it in the pipeline)", own.setting)
+		}
+	}
+	app, err := ctx.AppIfConfigured("adobe_usage")
+	if err != nil {
+		return fmt.Errorf("pipeline %s requires the adobe_usage app: %v", m.Pipeline, err)
+	}
+	p := app.(*UsageApp).pipelines[m.Pipeline]
+	if p == nil {
+		return fmt.Errorf("pipeline %s is not configured in the adobe_usage app", m.Pipeline)
+	}
+	m.usePipeline(p)
+	return nil
+}
+
+// usePipeline makes the tracker upload via the given pipeline.
+func (m *AdobeUsageTracker) usePipeline(p *pipeline) {
+	m.sink = p.output.sink
+	m.uploads = p.output.uploads
+	m.dedupe = p.output.dedupe
+}
+
+// parseAppOption unmarshals the adobe_usage global option, which
+// configures the adobe_usage app:
+//
+//	adobe_usage {
+//	    pipeline <name> {
+//	        endpoint <url>
+//	        ...
+//	    }
+//	}
+//
+// Pipelines accept the tracker's Influx, retry, dry run, and
+// dedupe settings, with the same syntax.
+func parseAppOption(d *caddyfile.Dispenser, _ any) (any, error) {
+	app := UsageApp{Pipelines: make(map[string]*Pipeline)}
+	d.Next() // consume option name
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if d.Val() != "pipeline" {
+			return nil, d.Errf("unrecognized adobe_usage option %q", d.Val())
+		}
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		name := d.Val()
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		if _, ok := app.Pipelines[name]; ok {
+			return nil, d.Errf("pipeline %s is configured more than once", name)
+		}
+		p, err := unmarshalPipeline(d)
+		if err != nil {
+			return nil, err
+		}
+		app.Pipelines[name] = p
+	}
+	return httpcaddyfile.App{Name: "adobe_usage", Value: caddyconfig.JSON(app, nil)}, nil
+}
+
+// unmarshalPipeline reads the block of a pipeline option.
+func unmarshalPipeline(d *caddyfile.Dispenser) (*Pipeline, error) {
+	p := new(Pipeline)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		key := d.Val()
+		switch key {
+		case "verify_on_start":
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			p.VerifyOnStart = true
+			continue
+		case "dry_run":
+			p.DryRun = true
+			if d.NextArg() {
+				p.DryRunFile = d.Val()
+			}
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			continue
+		case "dedupe":
+			p.Dedupe = defaultDedupeSize
+			if d.NextArg() {
+				n, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return nil, d.Errf("invalid dedupe size %q: %v", d.Val(), err)
+				}
+				p.Dedupe = n
+			}
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			continue
+		}
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		switch key {
+		case "endpoint":
+			p.Endpoint = d.Val()
+		case "database":
+			p.Database = d.Val()
+		case "policy":
+			p.Policy = d.Val()
+		case "token":
+			p.Token = d.Val()
+		case "token_file":
+			p.TokenFile = d.Val()
+		case "dedupe_file":
+			p.DedupeFile = d.Val()
+		case "max_retry_time":
+			if d.Val() == "off" {
+				p.MaxRetryTime = -1
+				break
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid max_retry_time %q: %v", d.Val(), err)
+			}
+			p.MaxRetryTime = caddy.Duration(dur)
+		case "breaker_threshold":
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid breaker_threshold %q: %v", d.Val(), err)
+			}
+			p.BreakerThreshold = n
+		case "max_uploads":
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid max_uploads %q: %v", d.Val(), err)
+			}
+			p.MaxUploads = n
+		case "breaker_cooldown":
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid breaker_cooldown %q: %v", d.Val(), err)
+			}
+			p.BreakerCooldown = caddy.Duration(dur)
+		default:
+			return nil, d.ArgErr()
+		}
+	}
+	return p, nil
+}
+
+// Interface guards
+var (
+	_ caddy.App          = (*UsageApp)(nil)
+	_ caddy.Provisioner  = (*UsageApp)(nil)
+	_ caddy.CleanerUpper = (*UsageApp)(nil)
+)
@@ -0,0 +1,193 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"encoding/json"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAppCaddyfile(t *testing.T) {
+	config := []byte(`{
+	order adobe_usage_tracker first
+	adobe_usage {
+		pipeline main {
+			endpoint https://influx.example.com
+			database Adobe
+			policy Default
+			token_file /run/secrets/influx
+			max_retry_time off
+			dedupe 500
+		}
+		pipeline staging {
+			dry_run /tmp/lines.txt
+		}
+	}
+}
+:80 {
+	adobe_usage_tracker {
+		pipeline main
+	}
+}
+:443 {
+	adobe_usage_tracker {
+		pipeline main
+		position last
+	}
+}`)
+	adapted, _, err := caddyfile.Adapter{ServerType: httpcaddyfile.ServerType{}}.Adapt(config, nil)
+	if err != nil {
+		t.Fatalf("Adapt failed: %v", err)
+	}
+	var parsed struct {
+		Apps struct {
+			Usage UsageApp `json:"adobe_usage"`
+		} `json:"apps"`
+	}
+	if err := json.Unmarshal(adapted, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	main, staging := parsed.Apps.Usage.Pipelines["main"], parsed.Apps.Usage.Pipelines["staging"]
+	if main == nil || main.Endpoint != "https://influx.example.com" || main.TokenFile != "/run/secrets/influx" ||
+		main.MaxRetryTime != -1 || main.Dedupe != 500 {
+		t.Errorf("Unexpected main pipeline: %+v", main)
+	}
+	if staging == nil || !staging.DryRun || staging.DryRunFile != "/tmp/lines.txt" {
+		t.Errorf("Unexpected staging pipeline: %+v", staging)
+	}
+	if strings.Count(string(adapted), `"pipeline":"main"`) != 2 {
+		t.Errorf("Expected both handlers to use the main pipeline:\n%s", adapted)
+	}
+	m, err := findTrackerConfig(adapted)
+	if err != nil || m.Endpoint != "https://influx.example.com" || m.Database != "Adobe" || m.Pipeline != "main" {
+		t.Errorf("Expected the pipeline's settings in the tracker config, got %+v (%v)", m, err)
+	}
+	for _, bad := range []string{
+		`{
+	adobe_usage {
+		pipeline
+	}
+}`,
+		`{
+	adobe_usage {
+		pipeline main {
+			dry_run
+		}
+		pipeline main {
+			dry_run
+		}
+	}
+}`,
+		`{
+	adobe_usage {
+		tracker main
+	}
+}`,
+	} {
+		if _, _, err := (caddyfile.Adapter{ServerType: httpcaddyfile.ServerType{}}).Adapt([]byte(bad), nil); err == nil {
+			t.Errorf("Expected an error adapting:\n%s", bad)
+		}
+	}
+}
+
+func TestPipelinesSharedAcrossReloads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dry-run.txt")
+	config := func() *UsageApp {
+		return &UsageApp{Pipelines: map[string]*Pipeline{"main": {DryRun: true, DryRunFile: path, Dedupe: 10}}}
+	}
+	old := config()
+	if err := old.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := config()
+	if err := reloaded.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	if old.pipelines["main"] != reloaded.pipelines["main"] {
+		t.Errorf("Expected the reloaded app to share the pipeline")
+	}
+	if err := old.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	changed := config()
+	changed.Pipelines["main"].Dedupe = 20
+	if err := changed.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	if changed.pipelines["main"] == reloaded.pipelines["main"] {
+		t.Errorf("Expected a changed pipeline not to be shared")
+	}
+	if err := changed.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	// the pipeline still works after the old app is cleaned up
+	sink := reloaded.pipelines["main"].output.sink
+	if err := sink.uploadLines([]string{"test-line value=1i"}, caddy.Log()); err != nil {
+		t.Errorf("Upload via the shared pipeline failed: %v", err)
+	}
+	if err := reloaded.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := os.ReadFile(path); err != nil || string(buf) != "test-line value=1i\n" {
+		t.Errorf("Unexpected dry run output %q (%v)", buf, err)
+	}
+	bad := &UsageApp{Pipelines: map[string]*Pipeline{"main": {DryRunFile: path}}}
+	if err := bad.Provision(caddy.Context{}); err == nil || !strings.Contains(err.Error(), "pipeline main") {
+		t.Errorf("Expected an invalid pipeline to fail, got %v", err)
+	}
+}
+
+func TestTrackerPipelineSettings(t *testing.T) {
+	m := &AdobeUsageTracker{Pipeline: "main", Database: "Adobe", Position: "first"}
+	if err := m.Provision(caddy.Context{}); err == nil || !strings.Contains(err.Error(), "database cannot be used") {
+		t.Errorf("Expected the tracker's own database to conflict with the pipeline, got %v", err)
+	}
+	m = &AdobeUsageTracker{Pipeline: "main", Position: "first"}
+	if err := m.Provision(caddy.Context{}); err == nil || !strings.Contains(err.Error(), "requires the adobe_usage app") {
+		t.Errorf("Expected a missing app to be an error, got %v", err)
+	}
+}
+
+func TestPipelineSharedBySites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dry-run.txt")
+	app := &UsageApp{Pipelines: map[string]*Pipeline{"main": {DryRun: true, DryRunFile: path, Dedupe: 100}}}
+	if err := app.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = app.Cleanup() }()
+	var sites []*AdobeUsageTracker
+	for range 2 {
+		// attachPipeline finds the app in the running config, so the
+		// trackers are given the app's pipeline directly
+		m := &AdobeUsageTracker{DryRun: true, DryRunFile: os.DevNull, Header: "X-Forwarded-For", Position: "first"}
+		if err := m.Provision(caddy.Context{}); err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = m.Cleanup() }()
+		m.usePipeline(app.pipelines["main"])
+		sites = append(sites, m)
+	}
+	// an upload emitted via one site is a duplicate at the other
+	serveLog(t, sites[0], "indesign-single-session-1.txt")
+	serveLog(t, sites[1], "indesign-single-session-1.txt")
+	out, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(out), "log-session,"); n != 1 {
+		t.Errorf("Expected one session line from the shared pipeline, got:\n%s", out)
+	}
+	if r := sites[1].stats.report(); r.DupUploads != 1 {
+		t.Errorf("Expected the second site to find a duplicate, got %+v", r)
+	}
+}
@@ -0,0 +1,337 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	archiveDayFormat  = "2006-01-02"
+	archiveTimeFormat = "20060102T150405.000000000Z"
+	archiveSuffix     = ".log.gz"
+	archivePruneEvery = time.Hour
+)
+
+// A bodyArchive keeps a compressed copy of each uploaded request
+// body, so that sessions can be re-derived from them later using
+// an improved parser. Bodies are kept in one directory per (UTC) day,
+// in files named by the time they were received and the client IP.
+// Bodies older than the retention period (if non-zero) are removed.
+type bodyArchive struct {
+	dir       string
+	retention time.Duration
+	now       func() time.Time
+
+	mu        sync.Mutex
+	lastPrune time.Time
+}
+
+func newBodyArchive(dir string, retention time.Duration) *bodyArchive {
+	return &bodyArchive{dir: dir, retention: retention, now: time.Now}
+}
+
+// An archivedBody is a request body read back from the archive.
+type archivedBody struct {
+	path     string
+	received time.Time
+	clientIp string
+	body     []byte
+}
+
+// store archives a request body received from the given client.
+// The client IP and time received are also kept in the gzip header,
+// since the file name has to sanitize the IP.
+func (a *bodyArchive) store(received time.Time, clientIp string, body []byte, logger *zap.Logger) error {
+	received = received.UTC()
+	dir := filepath.Join(a.dir, received.Format(archiveDayFormat))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	name := received.Format(archiveTimeFormat) + "_" + archiveFileIp(clientIp)
+	var file *os.File
+	var err error
+	for i := 0; ; i++ {
+		path := filepath.Join(dir, name+archiveSuffix)
+		if i > 0 {
+			path = filepath.Join(dir, fmt.Sprintf("%s-%d%s", name, i, archiveSuffix))
+		}
+		file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if !errors.Is(err, fs.ErrExist) {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(file)
+	zw.Comment = clientIp
+	zw.ModTime = received
+	if _, err = zw.Write(body); err == nil {
+		err = zw.Close()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return err
+	}
+	a.maybePrune(logger)
+	return nil
+}
+
+// archiveFileIp makes a client IP safe for use in a file name.
+func archiveFileIp(ip string) string {
+	if ip == "" {
+		return "unknown"
+	}
+	return strings.NewReplacer(":", "-", "/", "-", "\\", "-").Replace(ip)
+}
+
+// maybePrune starts a background prune of expired bodies if
+// there is a retention period and it's time for another prune.
+func (a *bodyArchive) maybePrune(logger *zap.Logger) {
+	if a.retention <= 0 {
+		return
+	}
+	now := a.now()
+	a.mu.Lock()
+	if now.Sub(a.lastPrune) < archivePruneEvery {
+		a.mu.Unlock()
+		return
+	}
+	a.lastPrune = now
+	a.mu.Unlock()
+	go func() {
+		if err := a.prune(now); err != nil {
+			logger.Warn("AdobeUsageTracker: failed to prune archive", zap.String("dir", a.dir), zap.Error(err))
+		}
+	}()
+}
+
+// prune removes the day directories that are entirely older than
+// the retention period, and any older bodies in the oldest day kept.
+func (a *bodyArchive) prune(now time.Time) error {
+	cutoff := now.Add(-a.retention).UTC()
+	entries, err := os.ReadDir(a.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		day, err := time.Parse(archiveDayFormat, entry.Name())
+		if !entry.IsDir() || err != nil {
+			continue
+		}
+		dir := filepath.Join(a.dir, entry.Name())
+		if !day.AddDate(0, 0, 1).After(cutoff) {
+			if err := os.RemoveAll(dir); err != nil {
+				return err
+			}
+			continue
+		}
+		if !day.Before(cutoff) {
+			continue
+		}
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if received, ok := archiveFileTime(file.Name()); ok && received.Before(cutoff) {
+				if err := os.Remove(filepath.Join(dir, file.Name())); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// archiveFileTime returns the time encoded in an archive file name.
+func archiveFileTime(name string) (time.Time, bool) {
+	stamp, _, found := strings.Cut(name, "_")
+	if !found || !strings.HasSuffix(name, archiveSuffix) {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(archiveTimeFormat, stamp)
+	return t, err == nil
+}
+
+// readArchive calls fn, in the order they were received, on each
+// body in the archive at dir that was received in [since, until).
+// A zero since or until leaves that end of the range open.
+func readArchive(dir string, since, until time.Time, fn func(archivedBody) error) error {
+	var paths []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		received, ok := archiveFileTime(d.Name())
+		if !ok {
+			return nil
+		}
+		if (!since.IsZero() && received.Before(since)) || (!until.IsZero() && !received.Before(until)) {
+			return nil
+		}
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return filepath.Base(paths[i]) < filepath.Base(paths[j])
+	})
+	for _, path := range paths {
+		body, err := readArchivedBody(path)
+		if err != nil {
+			return err
+		}
+		if err := fn(body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readArchivedBody(path string) (archivedBody, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return archivedBody{}, err
+	}
+	defer file.Close()
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		return archivedBody{}, fmt.Errorf("%s: %v", path, err)
+	}
+	buf, err := io.ReadAll(zr)
+	if err != nil {
+		return archivedBody{}, fmt.Errorf("%s: %v", path, err)
+	}
+	return archivedBody{path: path, received: zr.ModTime.UTC(), clientIp: zr.Comment, body: buf}, nil
+}
+
+func newReplayCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "replay [--since <time>] [--until <time>] [--output influx|stdout|file] [--file <path>] [influx flags] <archive-directory>",
+		Short: "Re-derive sessions from archived request bodies",
+		Long: `
+Re-runs the current parser over the request bodies saved by a
+tracker's archive_dir, and re-emits the sessions found. This allows
+improvements in parsing to be applied to historic uploads.
+
+Only bodies received at or after --since and before --until are
+replayed; each is either an RFC 3339 time or a date (YYYY-MM-DD,
+meaning midnight UTC). The sessions are written as Influx line
+protocol to stdout (the default), to a file (--output file with
+--file), or uploaded to Influx (--output influx). When uploading,
+the Influx endpoint is specified either by a Caddy config file
+(--config) that contains an adobe_usage_tracker handler or by
+explicit flags (which take precedence).`,
+		Args: cobra.ExactArgs(1),
+	}
+	cmd.Flags().String("since", "", "Replay bodies received at or after this time")
+	cmd.Flags().String("until", "", "Replay bodies received before this time")
+	cmd.Flags().Int("batch-size", defaultBackfillBatch, "Number of sessions to send in each batch")
+	addOutputFlags(cmd)
+	cmd.RunE = caddycmd.WrapCommandFuncForCobra(cmdReplay)
+	return cmd
+}
+
+func cmdReplay(fl caddycmd.Flags) (int, error) {
+	since, err := parseReplayTime(fl.String("since"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	until, err := parseReplayTime(fl.String("until"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	sink, closeSink, err := outputSinkFromFlags(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer closeSink()
+	bodies, sessions, err := replayArchive(fl.Arg(0), since, until, sink, fl.Int("batch-size"), caddy.Log())
+	_, _ = fmt.Fprintf(os.Stderr, "Replayed %d sessions from %d archived bodies\n", sessions, bodies)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+// parseReplayTime parses an RFC 3339 time or a date. An
+// empty value is the zero time, meaning no limit.
+func parseReplayTime(value string) (time.Time, error) {
+	return parseTimeIn(value, time.UTC)
+}
+
+// parseTimeIn parses an RFC 3339 time or a date, which is taken
+// to be midnight in loc. An empty value is the zero time.
+func parseTimeIn(value string, loc *time.Location) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(archiveDayFormat, value, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither an RFC 3339 time nor a YYYY-MM-DD date", value)
+	}
+	return t, nil
+}
+
+// replayArchive parses the bodies in the archive that were received
+// in [since, until) and sends the sessions found to the sink in
+// batches. It returns the number of bodies and sessions replayed.
+func replayArchive(dir string, since, until time.Time, sink lineSink, batchSize int, logger *zap.Logger) (int, int, error) {
+	if batchSize <= 0 {
+		batchSize = defaultBackfillBatch
+	}
+	bodies, sent := 0, 0
+	var pending []logSession
+	flush := func() error {
+		if err := sendSessions(sink, pending, logger); err != nil {
+			return err
+		}
+		sent += len(pending)
+		pending = pending[:0]
+		return nil
+	}
+	err := readArchive(dir, since, until, func(body archivedBody) error {
+		bodies++
+		pending = append(pending, parseLog(string(body.body), body.clientIp)...)
+		if len(pending) >= batchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	return bodies, sent, err
+}
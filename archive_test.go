@@ -0,0 +1,107 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"bytes"
+	"go.uber.org/zap/zaptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchiveStoreAndReplay(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	archive := newBodyArchive(t.TempDir(), 0)
+	day := time.Date(2024, 5, 30, 15, 0, 0, 0, time.UTC)
+	for i, name := range []string{
+		"indesign-single-session-1.txt",
+		"indesign-single-session-2.txt",
+		"indesign-multi-session-1-2.txt",
+	} {
+		buf, err := os.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := archive.store(day.Add(time.Duration(i)*time.Hour), "2001:db8::1", buf, logger); err != nil {
+			t.Fatalf("store failed: %v", err)
+		}
+	}
+	var bodies []archivedBody
+	err := readArchive(archive.dir, time.Time{}, time.Time{}, func(body archivedBody) error {
+		bodies = append(bodies, body)
+		return nil
+	})
+	if err != nil || len(bodies) != 3 {
+		t.Fatalf("Expected 3 archived bodies, got %d (%v)", len(bodies), err)
+	}
+	if bodies[0].clientIp != "2001:db8::1" || !bodies[0].received.Equal(day) {
+		t.Errorf("Archive header not preserved: %q at %v", bodies[0].clientIp, bodies[0].received)
+	}
+	var out bytes.Buffer
+	count, sessions, err := replayArchive(archive.dir, day.Add(time.Hour), day.Add(3*time.Hour), &writerSink{w: &out}, 0, logger)
+	if err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+	if count != 2 || sessions != 3 {
+		t.Errorf("Expected 3 sessions from 2 bodies, got %d from %d", sessions, count)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[0], "dbd904d9") || !strings.Contains(lines[0], `clientIp="2001:db8::1"`) {
+		t.Errorf("Unexpected replay output:\n%s", out.String())
+	}
+}
+
+func TestArchivePrune(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	archive := newBodyArchive(t.TempDir(), 48*time.Hour)
+	now := time.Date(2024, 5, 30, 12, 0, 0, 0, time.UTC)
+	archive.now = func() time.Time { return now }
+	// mark the archive as just pruned, so storing doesn't start a prune
+	archive.lastPrune = now
+	for _, received := range []time.Time{
+		now.Add(-96 * time.Hour),
+		now.Add(-49 * time.Hour),
+		now.Add(-47 * time.Hour),
+		now,
+	} {
+		if err := archive.store(received, "10.0.0.1", []byte("body"), logger); err != nil {
+			t.Fatalf("store failed: %v", err)
+		}
+	}
+	if err := archive.prune(now); err != nil {
+		t.Fatalf("prune failed: %v", err)
+	}
+	var kept []time.Time
+	err := readArchive(archive.dir, time.Time{}, time.Time{}, func(body archivedBody) error {
+		kept = append(kept, body.received)
+		return nil
+	})
+	if err != nil || len(kept) != 2 || !kept[0].Equal(now.Add(-47*time.Hour)) {
+		t.Errorf("Expected the 2 newest bodies to be kept, got %v (%v)", kept, err)
+	}
+	if _, err := os.Stat(filepath.Join(archive.dir, "2024-05-26")); !os.IsNotExist(err) {
+		t.Errorf("Expected expired day directory to be removed")
+	}
+}
+
+func TestParseReplayTime(t *testing.T) {
+	if ts, err := parseReplayTime("2024-05-30"); err != nil || !ts.Equal(time.Date(2024, 5, 30, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected date parse: %v (%v)", ts, err)
+	}
+	if ts, err := parseReplayTime("2024-05-30T08:00:00-07:00"); err != nil || ts.UTC().Hour() != 15 {
+		t.Errorf("Unexpected time parse: %v (%v)", ts, err)
+	}
+	if ts, err := parseReplayTime(""); err != nil || !ts.IsZero() {
+		t.Errorf("Expected zero time for empty value, got %v (%v)", ts, err)
+	}
+	if _, err := parseReplayTime("yesterday"); err == nil {
+		t.Errorf("Expected an error for an invalid time")
+	}
+}
@@ -0,0 +1,251 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	backfillManifest     = "manifest.json"
+	backfillStateFile    = ".backfill-state.json"
+	defaultBackfillBatch = 5000
+)
+
+func newBackfillCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "backfill [--batch-size <n>] [--state <file>] [influx flags] <directory>",
+		Short: "Bulk-import historic NGL logs from a directory tree",
+		Long: `
+Imports the sessions found in a tree of historic NGLClient logs,
+such as the rotated logs collected from machines when the tracker
+is first rolled out. Each subdirectory of the given directory holds
+the logs from one machine. The client IP for those logs is the name
+of the subdirectory, unless the subdirectory contains a manifest.json
+file of the form {"clientIp": "<address>"}.
+
+Sessions found in more than one log (such as when a log was split)
+are combined, keeping the longest launch duration. The sessions are
+uploaded to Influx in large batches, with progress reported as each
+batch completes. A record of what has been uploaded is kept in a
+state file (by default .backfill-state.json in the log directory),
+so an interrupted backfill can be resumed by running it again.
+
+The Influx endpoint is specified either by a Caddy config file
+(--config) that contains an adobe_usage_tracker handler or by
+explicit flags (which take precedence).`,
+		Args: cobra.ExactArgs(1),
+	}
+	cmd.Flags().Int("batch-size", defaultBackfillBatch, "Number of sessions to upload in each request")
+	cmd.Flags().String("state", "", "File that records backfill progress")
+	addInfluxFlags(cmd)
+	cmd.RunE = caddycmd.WrapCommandFuncForCobra(cmdBackfill)
+	return cmd
+}
+
+func cmdBackfill(fl caddycmd.Flags) (int, error) {
+	root := fl.Arg(0)
+	m, err := trackerFromFlags(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	statePath := fl.String("state")
+	if statePath == "" {
+		statePath = filepath.Join(root, backfillStateFile)
+	}
+	sink := newInfluxSink(m.ep, m.db, m.rp, m.tok, defaultRetryPolicy)
+	_, err = runBackfill(root, sink, statePath, fl.Int("batch-size"), os.Stderr, caddy.Log())
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+// backfillResult summarizes a backfill run.
+type backfillResult struct {
+	files    int // log files parsed
+	sessions int // distinct sessions found
+	skipped  int // sessions already uploaded by an earlier run
+	uploaded int // sessions uploaded by this run
+}
+
+// runBackfill parses all the logs under root, combines sessions by
+// sessionId, and uploads any sessions not already recorded in the
+// state file in batches of the given size, updating the state file
+// after each batch. Progress is reported to the given writer.
+func runBackfill(root string, sink lineSink, statePath string, batchSize int, progress io.Writer, logger *zap.Logger) (backfillResult, error) {
+	var result backfillResult
+	if batchSize <= 0 {
+		batchSize = defaultBackfillBatch
+	}
+	state, err := loadBackfillState(statePath)
+	if err != nil {
+		return result, err
+	}
+	sessions, files, err := collectBackfillSessions(root)
+	if err != nil {
+		return result, err
+	}
+	result.files, result.sessions = files, len(sessions)
+	var pending []logSession
+	for _, session := range sessions {
+		if uploaded, ok := state.Uploaded[session.sessionId]; ok && uploaded >= session.launchDuration.Milliseconds() {
+			result.skipped++
+			continue
+		}
+		pending = append(pending, session)
+	}
+	_, _ = fmt.Fprintf(progress, "Found %d sessions in %d files; %d already uploaded, %d to upload\n",
+		result.sessions, result.files, result.skipped, len(pending))
+	batches := (len(pending) + batchSize - 1) / batchSize
+	for i := 0; i < batches; i++ {
+		batch := pending[i*batchSize : min((i+1)*batchSize, len(pending))]
+		if err := sendSessions(sink, batch, logger); err != nil {
+			return result, fmt.Errorf("batch %d of %d failed (run again to resume): %w", i+1, batches, err)
+		}
+		for _, session := range batch {
+			state.Uploaded[session.sessionId] = session.launchDuration.Milliseconds()
+		}
+		if err := state.save(statePath); err != nil {
+			return result, err
+		}
+		result.uploaded += len(batch)
+		_, _ = fmt.Fprintf(progress, "Uploaded batch %d of %d (%d of %d sessions)\n",
+			i+1, batches, result.uploaded, len(pending))
+	}
+	return result, nil
+}
+
+// collectBackfillSessions parses every log under root, attributing
+// each machine's logs to its client IP, and returns the distinct
+// sessions found (ordered by launch time) and the number of files.
+func collectBackfillSessions(root string) ([]logSession, int, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, 0, err
+	}
+	merged := make(map[string]logSession)
+	files := 0
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		dir := filepath.Join(root, entry.Name())
+		ip, err := machineClientIp(dir)
+		if err != nil {
+			return nil, 0, err
+		}
+		err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), ".") || d.Name() == backfillManifest {
+				return nil
+			}
+			buf, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			files++
+			for _, session := range parseLog(string(buf), ip) {
+				if prior, ok := merged[session.sessionId]; ok {
+					session = mergeSession(prior, session)
+				}
+				merged[session.sessionId] = session
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	sessions := make([]logSession, 0, len(merged))
+	for _, session := range merged {
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].launchTime.Equal(sessions[j].launchTime) {
+			return sessions[i].launchTime.Before(sessions[j].launchTime)
+		}
+		return sessions[i].sessionId < sessions[j].sessionId
+	})
+	return sessions, files, nil
+}
+
+// machineClientIp returns the client IP for the logs in a machine's
+// directory: the one in its manifest, if it has one, else its name.
+func machineClientIp(dir string) (string, error) {
+	buf, err := os.ReadFile(filepath.Join(dir, backfillManifest))
+	if errors.Is(err, fs.ErrNotExist) {
+		return filepath.Base(dir), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var manifest struct {
+		ClientIp string `json:"clientIp"`
+	}
+	if err := json.Unmarshal(buf, &manifest); err != nil {
+		return "", fmt.Errorf("%s: invalid manifest: %v", dir, err)
+	}
+	if manifest.ClientIp == "" {
+		return "", fmt.Errorf("%s: manifest has no clientIp", dir)
+	}
+	return manifest.ClientIp, nil
+}
+
+// backfillState records the launch duration (in milliseconds) last
+// uploaded for each session, so that a rerun only uploads sessions
+// that are new or have grown since.
+type backfillState struct {
+	Uploaded map[string]int64 `json:"uploaded"`
+}
+
+func loadBackfillState(path string) (*backfillState, error) {
+	state := &backfillState{Uploaded: map[string]int64{}}
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, state); err != nil {
+		return nil, fmt.Errorf("invalid backfill state file %s: %v", path, err)
+	}
+	if state.Uploaded == nil {
+		state.Uploaded = map[string]int64{}
+	}
+	return state, nil
+}
+
+// save writes the state atomically, so an interruption
+// can never leave a corrupt state file behind.
+func (s *backfillState) save(path string) error {
+	buf, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	temp := path + ".tmp"
+	if err := os.WriteFile(temp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
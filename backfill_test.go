@@ -0,0 +1,146 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"errors"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// recordingSink is a lineSink that remembers the lines it receives,
+// and fails once it has received failAfter uploads (if non-zero).
+type recordingSink struct {
+	lines     []string
+	uploads   int
+	failAfter int
+}
+
+func (r *recordingSink) uploadLines(lines []string, _ *zap.Logger) error {
+	if r.failAfter > 0 && r.uploads >= r.failAfter {
+		return &uploadError{status: 503, retryable: true}
+	}
+	r.uploads++
+	r.lines = append(r.lines, lines...)
+	return nil
+}
+
+// copyTestdata copies the named testdata file into dir.
+func copyTestdata(t *testing.T, name string, dir string) {
+	buf, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// backfillTree creates a directory tree with logs from two machines,
+// one named by its IP and one with a manifest, and returns its root.
+func backfillTree(t *testing.T) string {
+	root := t.TempDir()
+	copyTestdata(t, "indesign-split-session-1-1.txt", filepath.Join(root, "10.0.0.1"))
+	copyTestdata(t, "indesign-split-session-1-2.txt", filepath.Join(root, "10.0.0.1"))
+	machine := filepath.Join(root, "machine-b")
+	copyTestdata(t, "indesign-multi-session-1-1.txt", machine)
+	copyTestdata(t, "indesign-multi-session-1-2.txt", filepath.Join(machine, "older"))
+	if err := os.WriteFile(filepath.Join(machine, backfillManifest), []byte(`{"clientIp": "10.0.0.2"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestBackfillDedupesSessions(t *testing.T) {
+	root := backfillTree(t)
+	sessions, files, err := collectBackfillSessions(root)
+	if err != nil {
+		t.Fatalf("collectBackfillSessions failed: %v", err)
+	}
+	if files != 4 || len(sessions) != 3 {
+		t.Fatalf("Expected 3 sessions from 4 files, got %d from %d", len(sessions), files)
+	}
+	for _, session := range sessions {
+		switch session.sessionId {
+		case "ebe61ac3-0afb-48e0-80b5-885850f3b613.1708023261721":
+			if session.clientIp != "10.0.0.1" || session.appId != "InDesign1" {
+				t.Errorf("Split session not merged correctly: %+v", session)
+			}
+			second := parseLogFile(t, "testdata/indesign-split-session-1-2.txt")[0]
+			if session.launchDuration != second.launchDuration {
+				t.Errorf("Expected longest duration %v, got %v", second.launchDuration, session.launchDuration)
+			}
+		default:
+			if session.clientIp != "10.0.0.2" {
+				t.Errorf("Expected manifest client IP 10.0.0.2, got %q", session.clientIp)
+			}
+		}
+	}
+}
+
+func TestBackfillResumes(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	root := backfillTree(t)
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	failing := &recordingSink{failAfter: 1}
+	result, err := runBackfill(root, failing, statePath, 2, io.Discard, logger)
+	var ue *uploadError
+	if !errors.As(err, &ue) || result.uploaded != 2 {
+		t.Fatalf("Expected failure after first batch of 2, got %d uploaded (%v)", result.uploaded, err)
+	}
+	sink := &recordingSink{}
+	result, err = runBackfill(root, sink, statePath, 2, io.Discard, logger)
+	if err != nil {
+		t.Fatalf("Resumed backfill failed: %v", err)
+	}
+	if result.skipped != 2 || result.uploaded != 1 || len(sink.lines) != 1 {
+		t.Errorf("Expected resume to upload 1 and skip 2, got %+v", result)
+	}
+	if !strings.Contains(sink.lines[0], `clientIp="10.0.0.2"`) {
+		t.Errorf("Expected last session from machine-b, got %q", sink.lines[0])
+	}
+	result, err = runBackfill(root, sink, statePath, 2, io.Discard, logger)
+	if err != nil || result.uploaded != 0 || result.skipped != 3 {
+		t.Errorf("Expected rerun to upload nothing, got %+v (%v)", result, err)
+	}
+}
+
+func TestFindTrackerConfig(t *testing.T) {
+	config := `{"apps": {"http": {"servers": {"srv0": {"routes": [{"handle": [
+		{"handler": "subroute", "routes": [{"handle": [
+			{"handler": "adobe_usage_tracker", "endpoint": "https://influx.example.com", "database": "db", "policy": "rp", "token": "tok"},
+			{"handler": "reverse_proxy"}
+		]}]}
+	]}]}}}}}`
+	m, err := findTrackerConfig([]byte(config))
+	if err != nil {
+		t.Fatalf("findTrackerConfig failed: %v", err)
+	}
+	if m.Endpoint != "https://influx.example.com" || m.Database != "db" || m.Policy != "rp" || m.Token != "tok" {
+		t.Errorf("Unexpected tracker config: %+v", m)
+	}
+	if _, err := findTrackerConfig([]byte(`{"apps": {}}`)); err == nil {
+		t.Errorf("Expected an error for a config without a tracker")
+	}
+}
+
+// parseLogFile parses the log file at path.
+func parseLogFile(t *testing.T, path string) []logSession {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parseLog(string(buf), "")
+}
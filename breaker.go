@@ -0,0 +1,169 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"errors"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// errBreakerOpen is returned for uploads that are dropped
+// because the circuit breaker is open.
+var errBreakerOpen = errors.New("upload circuit breaker is open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// A circuitBreaker wraps a lineSink so that, once the sink's
+// endpoint seems to be down, uploads are dropped immediately
+// rather than each one waiting to fail.
+//
+// The breaker opens after threshold consecutive uploads fail in a
+// way that suggests the endpoint is unavailable (that is, with a
+// retryable error). Once the cooldown has passed, the next upload
+// is let through as a probe (the half-open state): if it succeeds
+// the breaker closes again, and if it fails the breaker reopens.
+// Only one probe is in flight at a time. Each state transition
+// is logged once, rather than once per dropped upload.
+type circuitBreaker struct {
+	sink      lineSink
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+// newCircuitBreaker wraps sink in a breaker. Zero values for
+// threshold and cooldown mean use the defaults.
+func newCircuitBreaker(sink lineSink, threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		threshold = defaultBreakerThreshold
+	}
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+	return &circuitBreaker{sink: sink, threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// uploadLines implements lineSink. While the breaker is open,
+// the lines are dropped and errBreakerOpen is returned.
+func (b *circuitBreaker) uploadLines(lines []string, logger *zap.Logger) error {
+	probe, ok := b.allow(logger)
+	if !ok {
+		logger.Debug("AdobeUsageTracker: circuit breaker open, dropping lines", zap.Int("count", len(lines)))
+		return errBreakerOpen
+	}
+	err := b.sink.uploadLines(lines, logger)
+	b.record(probe, err, logger)
+	return err
+}
+
+// allow says whether an upload should go through and, if so,
+// whether it is a half-open probe.
+func (b *circuitBreaker) allow(logger *zap.Logger) (probe bool, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false, false
+		}
+		b.transition(breakerHalfOpen, logger)
+		b.probing = true
+		return true, true
+	case breakerHalfOpen:
+		if b.probing {
+			return false, false
+		}
+		b.probing = true
+		return true, true
+	default:
+		return false, true
+	}
+}
+
+// record updates the breaker state with the outcome of an upload.
+func (b *circuitBreaker) record(probe bool, err error, logger *zap.Logger) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+	}
+	var ue *uploadError
+	if err == nil || !errors.As(err, &ue) || !ue.retryable {
+		// the endpoint answered, even if it didn't like the request
+		b.failures = 0
+		if b.state != breakerClosed {
+			b.transition(breakerClosed, logger)
+		}
+		return
+	}
+	b.failures++
+	switch {
+	case b.state == breakerHalfOpen && probe:
+		b.openedAt = b.now()
+		b.transition(breakerOpen, logger)
+	case b.state == breakerClosed && b.failures >= b.threshold:
+		b.openedAt = b.now()
+		b.transition(breakerOpen, logger)
+	}
+}
+
+// transition changes state and logs the change. It must be
+// called with the mutex held.
+func (b *circuitBreaker) transition(to breakerState, logger *zap.Logger) {
+	from := b.state
+	b.state = to
+	fields := []zap.Field{zap.Stringer("from", from), zap.Stringer("to", to)}
+	switch to {
+	case breakerOpen:
+		logger.Error("AdobeUsageTracker: upload endpoint is down, circuit breaker opened",
+			append(fields, zap.Int("consecutive-failures", b.failures), zap.Duration("cooldown", b.cooldown))...)
+	case breakerHalfOpen:
+		logger.Info("AdobeUsageTracker: circuit breaker half-open, probing upload endpoint", fields...)
+	case breakerClosed:
+		logger.Info("AdobeUsageTracker: upload endpoint is back, circuit breaker closed", fields...)
+	}
+}
+
+// currentState returns the breaker's state.
+func (b *circuitBreaker) currentState() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"errors"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+	"testing"
+	"time"
+)
+
+// fakeSink is a lineSink that returns a preset error
+// and counts the uploads it receives.
+type fakeSink struct {
+	err   error
+	calls int
+}
+
+func (f *fakeSink) uploadLines([]string, *zap.Logger) error {
+	f.calls++
+	return f.err
+}
+
+func TestBreakerOpensAndRecovers(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	sink := &fakeSink{err: &uploadError{status: 503, retryable: true}}
+	b := newCircuitBreaker(sink, 3, time.Minute)
+	b.now = func() time.Time { return now }
+	lines := []string{"m f=1i 1"}
+	for i := 0; i < 3; i++ {
+		if err := b.uploadLines(lines, logger); errors.Is(err, errBreakerOpen) {
+			t.Fatalf("Breaker opened early, after %d failures", i)
+		}
+	}
+	if b.currentState() != breakerOpen {
+		t.Fatalf("Expected open breaker after 3 failures, got %v", b.currentState())
+	}
+	if err := b.uploadLines(lines, logger); !errors.Is(err, errBreakerOpen) {
+		t.Errorf("Expected errBreakerOpen, got %v", err)
+	}
+	if sink.calls != 3 {
+		t.Errorf("Expected open breaker to skip the sink, got %d calls", sink.calls)
+	}
+	// after the cooldown, a failed probe reopens the breaker
+	now = now.Add(time.Minute)
+	if err := b.uploadLines(lines, logger); errors.Is(err, errBreakerOpen) {
+		t.Errorf("Expected a probe after cooldown, got %v", err)
+	}
+	if b.currentState() != breakerOpen || sink.calls != 4 {
+		t.Errorf("Expected failed probe to reopen breaker, got %v with %d calls", b.currentState(), sink.calls)
+	}
+	// after another cooldown, a successful probe closes it
+	now = now.Add(time.Minute)
+	sink.err = nil
+	if err := b.uploadLines(lines, logger); err != nil {
+		t.Errorf("Expected probe to succeed, got %v", err)
+	}
+	if b.currentState() != breakerClosed {
+		t.Errorf("Expected closed breaker after successful probe, got %v", b.currentState())
+	}
+}
+
+func TestBreakerIgnoresPermanentErrors(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	sink := &fakeSink{err: &uploadError{status: 400}}
+	b := newCircuitBreaker(sink, 2, time.Minute)
+	for i := 0; i < 5; i++ {
+		_ = b.uploadLines([]string{"bad"}, logger)
+	}
+	if b.currentState() != breakerClosed || sink.calls != 5 {
+		t.Errorf("Expected permanent errors to leave breaker closed, got %v with %d calls", b.currentState(), sink.calls)
+	}
+}
+
+func TestBreakerSingleProbe(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	b := newCircuitBreaker(&fakeSink{err: &uploadError{retryable: true}}, 1, time.Second)
+	b.now = func() time.Time { return now }
+	_ = b.uploadLines(nil, logger)
+	now = now.Add(time.Second)
+	if probe, ok := b.allow(logger); !probe || !ok {
+		t.Fatalf("Expected first request after cooldown to be a probe")
+	}
+	if _, ok := b.allow(logger); ok {
+		t.Errorf("Expected second request during probe to be dropped")
+	}
+}
@@ -0,0 +1,172 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const checkTimeout = 15 * time.Second
+
+// A checkError reports which of the Influx settings (endpoint,
+// token, database, or policy) is the cause of a failed check.
+type checkError struct {
+	param   string
+	problem string
+	err     error
+}
+
+func (e *checkError) Error() string {
+	msg := fmt.Sprintf("%s: %s", e.param, e.problem)
+	if e.err != nil {
+		msg += fmt.Sprintf(" (%v)", e.err)
+	}
+	return msg
+}
+
+func (e *checkError) Unwrap() error {
+	return e.err
+}
+
+// check verifies the sink's settings by pinging its endpoint and
+// then writing an empty body to its database and policy, which
+// Influx validates without storing anything. It returns the
+// version of Influx reported by the ping, if any.
+func (s *influxSink) check(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", s.ep+"/ping", nil)
+	if err != nil {
+		return "", &checkError{param: "endpoint", problem: "invalid URL", err: err}
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return "", connectError(s.ep, err)
+	}
+	_, _ = io.Copy(io.Discard, res.Body)
+	_ = res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return "", &checkError{
+			param:   "endpoint",
+			problem: fmt.Sprintf("ping returned status %d; is %s an Influx server?", res.StatusCode, s.ep),
+		}
+	}
+	version := res.Header.Get("X-Influxdb-Version")
+	tok, err := s.tok.token()
+	if err != nil {
+		return version, &checkError{param: "token", problem: "cannot read token", err: err}
+	}
+	target := fmt.Sprintf("%s/write?db=%s&rp=%s&precision=ms", s.ep, url.QueryEscape(s.db), url.QueryEscape(s.rp))
+	req, err = http.NewRequestWithContext(ctx, "POST", target, strings.NewReader(""))
+	if err != nil {
+		return version, &checkError{param: "endpoint", problem: "invalid URL", err: err}
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Authorization", fmt.Sprintf("Token %s", tok))
+	res, err = s.client.Do(req)
+	if err != nil {
+		return version, connectError(s.ep, err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	return version, s.writeCheckError(res.StatusCode, influxErrorMessage(body))
+}
+
+// connectError classifies a failure to get any response from
+// the endpoint, distinguishing TLS problems from other failures.
+func connectError(ep string, err error) *checkError {
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	switch {
+	case errors.As(err, &certErr):
+		return &checkError{param: "endpoint", problem: "TLS certificate of " + ep + " is not trusted", err: err}
+	case errors.As(err, &recordErr):
+		return &checkError{param: "endpoint", problem: ep + " did not respond with TLS; is it really https?", err: err}
+	default:
+		return &checkError{param: "endpoint", problem: "cannot connect to " + ep, err: err}
+	}
+}
+
+// writeCheckError interprets the response to an empty write. An
+// empty write succeeds (or, on some servers, is rejected as having
+// no data) only if the token, database, and policy are all good.
+func (s *influxSink) writeCheckError(status int, message string) error {
+	lower := strings.ToLower(message)
+	switch {
+	case status/100 == 2:
+		return nil
+	case status == http.StatusBadRequest && !strings.Contains(lower, "not found"):
+		return nil
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return &checkError{param: "token", problem: fmt.Sprintf("not authorized to write to database %q: %s", s.db, message)}
+	case strings.Contains(lower, "dbrp") || strings.Contains(lower, "mapping"):
+		return &checkError{param: "policy", problem: fmt.Sprintf("no DBRP mapping for database %q and retention policy %q: %s", s.db, s.rp, message)}
+	case strings.Contains(lower, "retention policy"):
+		return &checkError{param: "policy", problem: fmt.Sprintf("retention policy %q not found in database %q: %s", s.rp, s.db, message)}
+	case status == http.StatusNotFound:
+		return &checkError{param: "database", problem: fmt.Sprintf("database %q not found: %s", s.db, message)}
+	default:
+		return &checkError{param: "endpoint", problem: fmt.Sprintf("test write returned status %d: %s", status, message)}
+	}
+}
+
+// verifyInflux checks the tracker's Influx settings
+// against its endpoint, with a bounded wait.
+func (m *AdobeUsageTracker) verifyInflux() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	return newInfluxSink(m.ep, m.db, m.rp, m.tok, defaultRetryPolicy).check(ctx)
+}
+
+func newCheckCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "check [influx flags]",
+		Short: "Verify the Influx endpoint, database, policy, and token",
+		Long: `
+Checks that the tracker's Influx settings work, by pinging the
+endpoint and then doing a test write (of no data) to the database
+and retention policy. If the check fails, the setting that is wrong
+is reported: endpoint (including TLS problems), token, database, or
+policy (including a missing DBRP mapping).
+
+The Influx settings are specified either by a Caddy config file
+(--config) that contains an adobe_usage_tracker handler or by
+explicit flags (which take precedence).`,
+		Args: cobra.NoArgs,
+	}
+	addInfluxFlags(cmd)
+	cmd.RunE = caddycmd.WrapCommandFuncForCobra(cmdCheck)
+	return cmd
+}
+
+func cmdCheck(fl caddycmd.Flags) (int, error) {
+	m, err := trackerFromFlags(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	version, err := m.verifyInflux()
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if version == "" {
+		version = "unknown version"
+	}
+	_, _ = fmt.Fprintf(os.Stdout, "OK: %s (Influx %s) accepts writes to database %q, retention policy %q\n",
+		m.ep, version, m.db, m.rp)
+	return caddy.ExitCodeSuccess, nil
+}
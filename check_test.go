@@ -0,0 +1,93 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// influxServer returns a test server that answers pings with
+// success and writes with the given status and message.
+func influxServer(t *testing.T, tls bool, status int, message string) *httptest.Server {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Influxdb-Version", "1.8.10")
+		if r.URL.Path == "/ping" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if r.URL.Path != "/write" || r.URL.Query().Get("db") != "db" || r.URL.Query().Get("rp") != "rp" {
+			t.Errorf("Unexpected check request: %s %s", r.Method, r.URL)
+		}
+		w.WriteHeader(status)
+		if message != "" {
+			_, _ = w.Write([]byte(`{"error": "` + message + `"}`))
+		}
+	})
+	server := httptest.NewUnstartedServer(handler)
+	if tls {
+		server.StartTLS()
+	} else {
+		server.Start()
+	}
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestCheckDiagnoses(t *testing.T) {
+	cases := []struct {
+		status  int
+		message string
+		param   string
+	}{
+		{http.StatusNoContent, "", ""},
+		{http.StatusBadRequest, "unable to parse '': missing fields", ""},
+		{http.StatusUnauthorized, "authorization failed", "token"},
+		{http.StatusForbidden, "insufficient permissions for write", "token"},
+		{http.StatusNotFound, "database not found: \\\"db\\\"", "database"},
+		{http.StatusNotFound, "retention policy not found: rp", "policy"},
+		{http.StatusNotFound, "no dbrp mapping found for database db and rp rp", "policy"},
+		{http.StatusInternalServerError, "oops", "endpoint"},
+	}
+	for _, c := range cases {
+		server := influxServer(t, false, c.status, c.message)
+		sink := newInfluxSink(server.URL, "db", "rp", staticToken("tok"), defaultRetryPolicy)
+		version, err := sink.check(context.Background())
+		if version != "1.8.10" {
+			t.Errorf("%d %q: expected version 1.8.10, got %q", c.status, c.message, version)
+		}
+		var ce *checkError
+		switch {
+		case c.param == "" && err != nil:
+			t.Errorf("%d %q: expected success, got %v", c.status, c.message, err)
+		case c.param != "" && (!errors.As(err, &ce) || ce.param != c.param):
+			t.Errorf("%d %q: expected a %s error, got %v", c.status, c.message, c.param, err)
+		}
+	}
+}
+
+func TestCheckDiagnosesConnections(t *testing.T) {
+	server := influxServer(t, true, http.StatusNoContent, "")
+	sink := newInfluxSink(server.URL, "db", "rp", staticToken("tok"), defaultRetryPolicy)
+	_, err := sink.check(context.Background())
+	var ce *checkError
+	if !errors.As(err, &ce) || ce.param != "endpoint" || !strings.Contains(ce.problem, "TLS") {
+		t.Errorf("Expected a TLS endpoint error, got %v", err)
+	}
+	sink.client = server.Client()
+	if _, err := sink.check(context.Background()); err != nil {
+		t.Errorf("Expected success with a trusting client, got %v", err)
+	}
+	server.Close()
+	if _, err := sink.check(context.Background()); !errors.As(err, &ce) || ce.param != "endpoint" {
+		t.Errorf("Expected an endpoint error for a closed server, got %v", err)
+	}
+}
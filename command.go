@@ -0,0 +1,331 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "adobe-usage",
+		Usage: "<subcommand> [flags] [args]",
+		Short: "Offline tools for Adobe usage tracking",
+		Long: `
+Offline tools that work with the same logs and measurements
+as the adobe_usage_tracker handler. Use "caddy adobe-usage help
+<subcommand>" for details of each subcommand.`,
+		CobraFunc: func(cmd *cobra.Command) {
+			cmd.AddCommand(newParseCommand())
+			cmd.AddCommand(newBackfillCommand())
+			cmd.AddCommand(newReplayCommand())
+			cmd.AddCommand(newCheckCommand())
+			cmd.AddCommand(newReportCommand())
+			cmd.AddCommand(newConcurrencyCommand())
+		},
+	})
+}
+
+func newParseCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "parse [--format table|json|line] [--client-ip <ip>] <file-or-directory>...",
+		Short: "Show the sessions the tracker would extract from log files",
+		Long: `
+Parses NGLClient log files, such as those sent in by users, and
+prints the sessions that the tracker would extract from them.
+Each argument is either a log file or a directory, in which case
+every file directly in the directory is parsed.
+
+The output format is a table (the default), JSON, or the
+Influx line protocol that the tracker would upload. Since the
+files weren't uploaded by a client, you can specify the client
+IP address to attribute the sessions to.`,
+		Args: cobra.MinimumNArgs(1),
+	}
+	cmd.Flags().StringP("format", "f", "table", "Output format: table, json, or line")
+	cmd.Flags().String("client-ip", "", "Client IP address to attribute sessions to")
+	cmd.RunE = caddycmd.WrapCommandFuncForCobra(cmdParse)
+	return cmd
+}
+
+func cmdParse(fl caddycmd.Flags) (int, error) {
+	format := fl.String("format")
+	if !slices.Contains([]string{"table", "json", "line"}, format) {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("unknown format %q: must be table, json, or line", format)
+	}
+	paths, err := expandLogPaths(fl.Args())
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	files, err := parseLogFiles(paths, fl.String("client-ip"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if err := printParsedFiles(os.Stdout, format, files); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+// addInfluxFlags adds flags that specify the Influx endpoint to
+// use, either directly or by naming a Caddy config file that has
+// an adobe_usage_tracker handler. Explicit flags take precedence
+// over values from the config file.
+func addInfluxFlags(cmd *cobra.Command) {
+	cmd.Flags().StringP("config", "c", "", "Caddy config file with an adobe_usage_tracker handler")
+	cmd.Flags().StringP("adapter", "a", "", "Name of config adapter to apply (when --config is used)")
+	cmd.Flags().String("endpoint", "", "Influx endpoint URL")
+	cmd.Flags().String("database", "", "Influx database name")
+	cmd.Flags().String("policy", "", "Influx retention policy name")
+	cmd.Flags().String("token", "", "Influx API token")
+	cmd.Flags().String("token-file", "", "File containing the Influx API token")
+}
+
+// addOutputFlags adds flags that choose where line protocol
+// goes: to stdout, to a file, or to Influx (in which case the
+// flags added by addInfluxFlags specify the endpoint).
+func addOutputFlags(cmd *cobra.Command) {
+	cmd.Flags().StringP("output", "o", "stdout", "Where to send line protocol: influx, stdout, or file")
+	cmd.Flags().String("file", "", "File to write line protocol to (with --output file)")
+	addInfluxFlags(cmd)
+}
+
+// outputSinkFromFlags returns the sink chosen by the flags added
+// by addOutputFlags, and a function to call when done with it.
+func outputSinkFromFlags(fl caddycmd.Flags) (lineSink, func(), error) {
+	switch output := fl.String("output"); output {
+	case "stdout":
+		return &writerSink{w: os.Stdout}, func() {}, nil
+	case "file":
+		path := fl.String("file")
+		if path == "" {
+			return nil, nil, fmt.Errorf("--output file requires a --file path")
+		}
+		file, err := os.Create(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &writerSink{w: file}, func() { _ = file.Close() }, nil
+	case "influx":
+		m, err := trackerFromFlags(fl)
+		if err != nil {
+			return nil, nil, err
+		}
+		return newInfluxSink(m.ep, m.db, m.rp, m.tok, defaultRetryPolicy), func() {}, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown output %q: must be influx, stdout, or file", output)
+	}
+}
+
+// trackerFromFlags returns a tracker whose Influx settings come from
+// the flags added by addInfluxFlags. The settings are validated (and
+// their placeholders resolved) but the tracker is not provisioned.
+func trackerFromFlags(fl caddycmd.Flags) (*AdobeUsageTracker, error) {
+	m := new(AdobeUsageTracker)
+	if configFile := fl.String("config"); configFile != "" {
+		config, _, err := caddycmd.LoadConfig(configFile, fl.String("adapter"))
+		if err != nil {
+			return nil, err
+		}
+		if m, err = findTrackerConfig(config); err != nil {
+			return nil, fmt.Errorf("%s: %v", configFile, err)
+		}
+	}
+	for flag, field := range map[string]*string{
+		"endpoint":   &m.Endpoint,
+		"database":   &m.Database,
+		"policy":     &m.Policy,
+		"token":      &m.Token,
+		"token-file": &m.TokenFile,
+	} {
+		if value := fl.String(flag); value != "" {
+			*field = value
+		}
+	}
+	if fl.String("token") != "" {
+		m.TokenFile = ""
+	} else if fl.String("token-file") != "" {
+		m.Token = ""
+	}
+	if err := m.provisionInflux(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// findTrackerConfig searches a JSON Caddy config for the first
+// adobe_usage_tracker handler and returns its configuration. If
+// the handler uses a pipeline, the pipeline's settings (which have
+// the same names as the tracker's) are filled in from the config.
+func findTrackerConfig(config []byte) (*AdobeUsageTracker, error) {
+	var tree any
+	if err := json.Unmarshal(config, &tree); err != nil {
+		return nil, err
+	}
+	var find func(node any) map[string]any
+	find = func(node any) map[string]any {
+		switch node := node.(type) {
+		case map[string]any:
+			if node["handler"] == "adobe_usage_tracker" {
+				return node
+			}
+			for _, child := range node {
+				if found := find(child); found != nil {
+					return found
+				}
+			}
+		case []any:
+			for _, child := range node {
+				if found := find(child); found != nil {
+					return found
+				}
+			}
+		}
+		return nil
+	}
+	handler := find(tree)
+	if handler == nil {
+		return nil, fmt.Errorf("no adobe_usage_tracker handler found in config")
+	}
+	raw, err := json.Marshal(handler)
+	if err != nil {
+		return nil, err
+	}
+	m := new(AdobeUsageTracker)
+	if err := json.Unmarshal(raw, m); err != nil {
+		return nil, err
+	}
+	if m.Pipeline == "" {
+		return m, nil
+	}
+	var apps struct {
+		Apps struct {
+			Usage UsageApp `json:"adobe_usage"`
+		} `json:"apps"`
+	}
+	if err := json.Unmarshal(config, &apps); err != nil {
+		return nil, err
+	}
+	p := apps.Apps.Usage.Pipelines[m.Pipeline]
+	if p == nil {
+		return nil, fmt.Errorf("pipeline %s not found in config", m.Pipeline)
+	}
+	if raw, err = json.Marshal(p); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// expandLogPaths replaces any directories among the given paths
+// with the (non-hidden) files directly inside them.
+func expandLogPaths(args []string) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			paths = append(paths, arg)
+			continue
+		}
+		entries, err := os.ReadDir(arg)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.Type().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+				paths = append(paths, filepath.Join(arg, entry.Name()))
+			}
+		}
+	}
+	return paths, nil
+}
+
+// A parsedFile holds the sessions parsed from a single log file,
+// and the report on how well the file parsed.
+type parsedFile struct {
+	Path     string       `json:"file"`
+	Sessions []logSession `json:"sessions"`
+	Quality  parseReport  `json:"quality"`
+}
+
+// parseLogFiles parses each of the files at the given paths,
+// attributing all the sessions found to the given client IP.
+func parseLogFiles(paths []string, ip string) ([]parsedFile, error) {
+	files := make([]parsedFile, 0, len(paths))
+	for _, path := range paths {
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		sessions, quality := parseLogReport(string(buf), ip)
+		files = append(files, parsedFile{Path: path, Sessions: sessions, Quality: quality})
+	}
+	return files, nil
+}
+
+// printParsedFiles writes the sessions from the parsed files to w
+// in the given format: table, json, or (Influx) line protocol.
+func printParsedFiles(w io.Writer, format string, files []parsedFile) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(files)
+	case "line":
+		for _, file := range files {
+			for _, session := range file.Sessions {
+				if _, err := fmt.Fprintln(w, sessionLine(session, zap.NewNop())); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	default:
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(tw, "FILE\tSESSION\tLAUNCH TIME\tDURATION\tAPP\tVERSION\tLOCALE\tOS\tNGL\tUSER")
+		for _, file := range files {
+			for _, s := range file.Sessions {
+				// a duration of a session that wasn't seen to end is a minimum
+				duration := s.launchDuration.Round(time.Millisecond).String()
+				if !s.logTerminated {
+					duration += "+"
+				}
+				_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+					filepath.Base(file.Path),
+					s.sessionId,
+					s.launchTime.Format(time.RFC3339),
+					duration,
+					s.appId,
+					s.appVersion,
+					s.appLocale,
+					strings.TrimSpace(s.osName+" "+s.osVersion),
+					s.nglVersion,
+					s.userId,
+				)
+			}
+		}
+		return tw.Flush()
+	}
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseTestdataDirectory(t *testing.T) {
+	paths, err := expandLogPaths([]string{"testdata"})
+	if err != nil {
+		t.Fatalf("Cannot expand testdata: %v", err)
+	}
+	files, err := parseLogFiles(paths, "10.0.0.1")
+	if err != nil {
+		t.Fatalf("Cannot parse testdata: %v", err)
+	}
+	if len(files) != len(paths) || len(files) < 15 {
+		t.Fatalf("Expected a result for each of %d testdata files, got %d", len(paths), len(files))
+	}
+	for _, file := range files {
+		for _, session := range file.Sessions {
+			if session.clientIp != "10.0.0.1" {
+				t.Errorf("%s: expected client IP 10.0.0.1, got %q", file.Path, session.clientIp)
+			}
+		}
+	}
+}
+
+func TestPrintParsedFiles(t *testing.T) {
+	files, err := parseLogFiles([]string{"testdata/NGLClient_Photoshop125.9.0.log"}, "10.0.0.1")
+	if err != nil {
+		t.Fatalf("Cannot parse log: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := printParsedFiles(&buf, "table", files); err != nil {
+		t.Fatalf("Table output failed: %v", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 2 ||
+		!strings.Contains(lines[1], "Photoshop1") || !strings.Contains(lines[1], "25.9.0") {
+		t.Errorf("Unexpected table output:\n%s", buf.String())
+	}
+	buf.Reset()
+	if err := printParsedFiles(&buf, "json", files); err != nil {
+		t.Fatalf("JSON output failed: %v", err)
+	}
+	var parsed []struct {
+		File     string           `json:"file"`
+		Sessions []map[string]any `json:"sessions"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &parsed); err != nil {
+		t.Fatalf("Invalid JSON output: %v\n%s", err, buf.String())
+	}
+	if len(parsed) != 1 || len(parsed[0].Sessions) != 1 || parsed[0].Sessions[0]["appId"] != "Photoshop1" {
+		t.Errorf("Unexpected JSON output:\n%s", buf.String())
+	}
+	buf.Reset()
+	if err := printParsedFiles(&buf, "line", files); err != nil {
+		t.Fatalf("Line output failed: %v", err)
+	}
+	if !strings.HasPrefix(buf.String(), "log-session,sessionId=ff55e1c3") || !strings.Contains(buf.String(), `clientIp="10.0.0.1"`) {
+		t.Errorf("Unexpected line output:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A componentActivity summarizes the log lines written by one NGL
+// component (such as ngl-lib_IMSConnector) during one session: how
+// many there were, how many threads wrote them, and the timestamps
+// of the first and last of them. Lines with unreadable timestamps
+// are counted, but don't affect the first and last times.
+type componentActivity struct {
+	component string
+	lines     int
+	threads   map[string]bool
+	first     time.Time
+	last      time.Time
+}
+
+// A componentTimeline accumulates the activity of each component
+// in a session as its log lines are parsed.
+type componentTimeline map[string]*componentActivity
+
+// add records a log line from the given component and thread.
+// Component names are normalized by removing spaces, because some
+// NGL components are logged as (e.g.) "ngl-lib_ NglIngestManager".
+func (c componentTimeline) add(component, thread string, t time.Time) {
+	component = strings.ReplaceAll(component, " ", "")
+	if component == "" {
+		return
+	}
+	a := c[component]
+	if a == nil {
+		a = &componentActivity{component: component, threads: make(map[string]bool)}
+		c[component] = a
+	}
+	a.lines++
+	if thread != "" {
+		a.threads[thread] = true
+	}
+	if t.IsZero() {
+		return
+	}
+	if a.first.IsZero() || t.Before(a.first) {
+		a.first = t
+	}
+	if t.After(a.last) {
+		a.last = t
+	}
+}
+
+// activities returns the recorded activities, ordered by the
+// time each component first logged (and then by name).
+func (c componentTimeline) activities() []componentActivity {
+	result := make([]componentActivity, 0, len(c))
+	for _, a := range c {
+		result = append(result, *a)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].first.Equal(result[j].first) {
+			return result[i].first.Before(result[j].first)
+		}
+		return result[i].component < result[j].component
+	})
+	return result
+}
+
+// componentLines constructs a session-component line for each
+// component that logged during the session. The startOffset is
+// the time from the session's launch to the component's first
+// line, and each point is timestamped at that first line (so the
+// points from different fragments of a split log don't collide).
+// Components with no readable timestamps are not included.
+func componentLines(s logSession) []string {
+	var lines []string
+	for _, a := range s.components {
+		if a.first.IsZero() {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf(
+			"session-component,sessionId=%s,component=%s lines=%di,threads=%di,startOffset=%di,duration=%di %d",
+			s.sessionId,
+			escapeTag(a.component),
+			a.lines,
+			len(a.threads),
+			a.first.Sub(s.launchTime).Milliseconds(),
+			a.last.Sub(a.first).Milliseconds(),
+			a.first.UnixMilli(),
+		))
+	}
+	return lines
+}
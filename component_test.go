@@ -0,0 +1,76 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestComponentTimeline(t *testing.T) {
+	sessions := parseLogFile(t, "testdata/indesign-single-session-1.txt")
+	if len(sessions) != 1 {
+		t.Fatalf("Expected 1 session, got %d", len(sessions))
+	}
+	s := sessions[0]
+	byName := make(map[string]componentActivity)
+	for _, a := range s.components {
+		byName[a.component] = a
+	}
+	ims, ok := byName["ngl-lib_IMSConnector"]
+	if !ok || ims.lines != 42 || ims.first.IsZero() || ims.last.Before(ims.first) {
+		t.Errorf("Unexpected IMSConnector activity: %+v", ims)
+	}
+	if ingest := byName["ngl-lib_NglIngestManager"]; ingest.lines != 11 || len(ingest.threads) < 2 {
+		t.Errorf("Expected normalized NglIngestManager activity on several threads, got %+v", ingest)
+	}
+	if first := s.components[0]; first.component != "ngl-lib_NglAppLib" || !first.first.Equal(s.launchTime) {
+		t.Errorf("Expected NglAppLib to log first, at launch, got %+v", first)
+	}
+	lines := componentLines(s)
+	if len(lines) != len(s.components) {
+		t.Fatalf("Expected a line per component, got %d of %d", len(lines), len(s.components))
+	}
+	if !strings.HasPrefix(lines[0], "session-component,sessionId="+s.sessionId+",component=ngl-lib_NglAppLib lines=22i,threads=15i,startOffset=0i,duration=15531i ") {
+		t.Errorf("Unexpected first component line: %s", lines[0])
+	}
+}
+
+func TestComponentTimelineAdd(t *testing.T) {
+	start := time.Date(2024, 5, 30, 12, 0, 0, 0, time.UTC)
+	c := make(componentTimeline)
+	c.add("ngl-lib_ SyncManager", "1", start.Add(2*time.Second))
+	c.add("ngl-lib_SyncManager", "2", start.Add(time.Second))
+	c.add("ngl-lib_SyncManager", "2", time.Time{})
+	c.add("ngl-lib_IMSConnector", "1", time.Time{})
+	c.add("", "1", start)
+	activities := c.activities()
+	if len(activities) != 2 || activities[0].component != "ngl-lib_IMSConnector" {
+		t.Fatalf("Unexpected activities: %+v", activities)
+	}
+	sync := activities[1]
+	if sync.lines != 3 || len(sync.threads) != 2 || !sync.first.Equal(start.Add(time.Second)) || !sync.last.Equal(start.Add(2*time.Second)) {
+		t.Errorf("Unexpected sync activity: %+v", sync)
+	}
+	lines := componentLines(logSession{sessionId: "s1", launchTime: start, components: activities})
+	expected := "session-component,sessionId=s1,component=ngl-lib_SyncManager lines=3i,threads=2i,startOffset=1000i,duration=1000i 1717070401000"
+	if len(lines) != 1 || lines[0] != expected {
+		t.Errorf("Expected only the timed component line %q, got %v", expected, lines)
+	}
+}
+
+func TestComponentTimelineCaddyfile(t *testing.T) {
+	var m AdobeUsageTracker
+	d := caddyfile.NewTestDispenser(`adobe_usage_tracker {
+		component_timeline
+	}`)
+	if err := m.UnmarshalCaddyfile(d); err != nil || !m.ComponentTimeline {
+		t.Errorf("Expected component_timeline to be set (%v)", err)
+	}
+}
@@ -0,0 +1,220 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"os"
+	"sort"
+	"time"
+)
+
+// A concurrencyPoint gives the peak number of simultaneous
+// sessions of an app during a day, and when the peak began.
+type concurrencyPoint struct {
+	appId    string
+	day      time.Time
+	peak     int
+	peakTime time.Time
+}
+
+// concurrencyLine constructs a line protocol line for the given
+// concurrencyPoint, timestamped at the start of its day.
+func concurrencyLine(p concurrencyPoint) string {
+	return fmt.Sprintf("concurrency,appId=%s peak=%di,peakTime=%di %d",
+		escapeTag(p.appId),
+		p.peak,
+		p.peakTime.UnixMilli(),
+		p.day.UnixMilli(),
+	)
+}
+
+// peakConcurrency computes, for each app and each day (in loc)
+// that overlaps [since, until), the peak number of sessions of
+// that app that were running at the same time. Each session runs
+// from its launch time for its launch duration; sessions that end
+// at the same moment another starts don't overlap. Sessions with
+// no appId are ignored. Points are ordered by day and then appId.
+func peakConcurrency(sessions []logSession, loc *time.Location, since, until time.Time) []concurrencyPoint {
+	type event struct {
+		at    time.Time
+		delta int
+	}
+	type key struct {
+		appId string
+		day   time.Time
+	}
+	events := make(map[key][]event)
+	for _, s := range sessions {
+		if s.appId == "" {
+			continue
+		}
+		start, end := s.launchTime, s.launchTime.Add(max(s.launchDuration, time.Millisecond))
+		if start.Before(since) {
+			start = since
+		}
+		if end.After(until) {
+			end = until
+		}
+		// split the session at each day boundary it crosses, so
+		// that it counts towards the peak of every day it runs in
+		for start.Before(end) {
+			day := startOfDay(start, loc)
+			next := day.AddDate(0, 0, 1)
+			stop := end
+			if next.Before(stop) {
+				stop = next
+			}
+			k := key{s.appId, day}
+			events[k] = append(events[k], event{start, 1}, event{stop, -1})
+			start = next
+		}
+	}
+	points := make([]concurrencyPoint, 0, len(events))
+	for k, evs := range events {
+		sort.Slice(evs, func(i, j int) bool {
+			if !evs[i].at.Equal(evs[j].at) {
+				return evs[i].at.Before(evs[j].at)
+			}
+			return evs[i].delta < evs[j].delta
+		})
+		p := concurrencyPoint{appId: k.appId, day: k.day}
+		count := 0
+		for _, ev := range evs {
+			count += ev.delta
+			if count > p.peak {
+				p.peak, p.peakTime = count, ev.at
+			}
+		}
+		points = append(points, p)
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if !points[i].day.Equal(points[j].day) {
+			return points[i].day.Before(points[j].day)
+		}
+		return points[i].appId < points[j].appId
+	})
+	return points
+}
+
+// startOfDay returns midnight (in loc) of the day containing t.
+func startOfDay(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
+
+// sendConcurrency uploads the given concurrency points to the sink.
+func sendConcurrency(sink lineSink, points []concurrencyPoint, logger *zap.Logger) error {
+	if len(points) == 0 {
+		return nil
+	}
+	lines := make([]string, 0, len(points))
+	for _, p := range points {
+		lines = append(lines, concurrencyLine(p))
+	}
+	return sink.uploadLines(lines, logger)
+}
+
+// runConcurrency periodically computes peak concurrency from the
+// tracker's session store and uploads it, until stop is closed.
+// Each run covers yesterday and today (so far), so that yesterday's
+// peak is complete even if its last sessions were uploaded late.
+func (m *AdobeUsageTracker) runConcurrency(interval time.Duration, stop <-chan struct{}) {
+	logger := caddy.Log()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			sessions, err := m.store.sessions()
+			if err != nil {
+				logger.Error("AdobeUsageTracker: cannot read session store", zap.Error(err))
+				continue
+			}
+			since := startOfDay(now, m.loc).AddDate(0, 0, -1)
+			points := peakConcurrency(sessions, m.loc, since, now)
+			if err := sendConcurrency(m.sink, points, logger); err != nil {
+				logger.Error("AdobeUsageTracker: failed to send concurrency", zap.Error(err))
+			}
+		}
+	}
+}
+
+func newConcurrencyCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "concurrency --store <file> [--since <date>] [--until <date>] [--timezone <tz>] [output flags]",
+		Short: "Compute peak concurrent sessions per app per day",
+		Long: `
+Computes, from the sessions in a tracker's session_store file, the
+peak number of simultaneous sessions of each app on each day, for
+sizing shared-device license pools. Days run from --since (default
+7 days ago) to --until (default now), and begin at midnight in the
+given --timezone (default UTC).
+
+The results are written as Influx line protocol for the
+"concurrency" measurement to stdout (the default), to a file
+(--output file with --file), or uploaded to Influx (--output
+influx, with the endpoint given by a Caddy config file or by
+explicit flags).`,
+		Args: cobra.NoArgs,
+	}
+	cmd.Flags().String("store", "", "Session store file kept by a tracker")
+	cmd.Flags().String("since", "", "First day to compute (default 7 days ago)")
+	cmd.Flags().String("until", "", "End of the last day to compute (default now)")
+	cmd.Flags().String("timezone", "UTC", "Time zone in which days begin")
+	addOutputFlags(cmd)
+	cmd.RunE = caddycmd.WrapCommandFuncForCobra(cmdConcurrency)
+	return cmd
+}
+
+func cmdConcurrency(fl caddycmd.Flags) (int, error) {
+	path := fl.String("store")
+	if path == "" {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("a --store file must be specified")
+	}
+	loc, err := time.LoadLocation(fl.String("timezone"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	until, err := parseTimeIn(fl.String("until"), loc)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if until.IsZero() {
+		until = time.Now()
+	}
+	since, err := parseTimeIn(fl.String("since"), loc)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if since.IsZero() {
+		since = startOfDay(until, loc).AddDate(0, 0, -7)
+	}
+	if _, err := os.Stat(path); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	sessions, err := readSessionStore(path)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	sink, closeSink, err := outputSinkFromFlags(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer closeSink()
+	if err := sendConcurrency(sink, peakConcurrency(sessions, loc, since, until), caddy.Log()); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	return caddy.ExitCodeSuccess, nil
+}
@@ -0,0 +1,66 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func concurrencySession(id, app string, start time.Time, duration time.Duration) logSession {
+	return logSession{sessionId: id, appId: app, launchTime: start, launchDuration: duration}
+}
+
+func TestPeakConcurrency(t *testing.T) {
+	day := time.Date(2024, 5, 30, 0, 0, 0, 0, time.UTC)
+	sessions := []logSession{
+		// three overlapping Photoshop sessions on the 30th
+		concurrencySession("p1", "Photoshop1", day.Add(9*time.Hour), 3*time.Hour),
+		concurrencySession("p2", "Photoshop1", day.Add(10*time.Hour), time.Hour),
+		concurrencySession("p3", "Photoshop1", day.Add(10*time.Hour+30*time.Minute), time.Hour),
+		// this one starts just as p2 ends, so doesn't add to the peak
+		concurrencySession("p4", "Photoshop1", day.Add(11*time.Hour), time.Minute),
+		// an overnight session counts on both days
+		concurrencySession("i1", "InDesign1", day.Add(23*time.Hour), 2*time.Hour),
+		concurrencySession("i2", "InDesign1", day.Add(24*time.Hour+30*time.Minute), time.Hour),
+		concurrencySession("x1", "", day.Add(10*time.Hour), time.Hour),
+	}
+	points := peakConcurrency(sessions, time.UTC, day, day.AddDate(0, 0, 2))
+	expected := []concurrencyPoint{
+		{"InDesign1", day, 1, day.Add(23 * time.Hour)},
+		{"Photoshop1", day, 3, day.Add(10*time.Hour + 30*time.Minute)},
+		{"InDesign1", day.AddDate(0, 0, 1), 2, day.Add(24*time.Hour + 30*time.Minute)},
+	}
+	if len(points) != len(expected) {
+		t.Fatalf("Expected %d points, got %+v", len(expected), points)
+	}
+	for i, p := range points {
+		e := expected[i]
+		if p.appId != e.appId || !p.day.Equal(e.day) || p.peak != e.peak || !p.peakTime.Equal(e.peakTime) {
+			t.Errorf("Point %d: expected %+v, got %+v", i, e, p)
+		}
+	}
+	line := concurrencyLine(points[1])
+	if line != "concurrency,appId=Photoshop1 peak=3i,peakTime=1717065000000i 1717027200000" {
+		t.Errorf("Unexpected line protocol: %s", line)
+	}
+	if line := concurrencyLine(concurrencyPoint{appId: "My App,1", day: day}); !strings.HasPrefix(line, `concurrency,appId=My\ App\,1 `) {
+		t.Errorf("Expected an escaped appId tag: %s", line)
+	}
+	// in Los Angeles, the InDesign sessions are both on the 30th
+	la, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Skipf("No timezone data: %v", err)
+	}
+	points = peakConcurrency(sessions, la, day, day.AddDate(0, 0, 2))
+	for _, p := range points {
+		if p.appId == "InDesign1" && (p.day.Day() != 30 || p.peak != 2) {
+			t.Errorf("Unexpected InDesign point in Los Angeles: %+v", p)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+const defaultDedupeSize = 10000
+
+// The kinds of duplicates found by a dedupeCache.
+const (
+	duplicateUpload  = "upload"
+	duplicateSession = "session"
+)
+
+// duplicatesFound counts the uploads and sessions that were not
+// emitted because they had been emitted before. It's registered
+// with the default registry, which Caddy's metrics endpoint serves.
+var duplicatesFound = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "caddy",
+	Subsystem: "adobe_usage_tracker",
+	Name:      "duplicates_total",
+	Help:      "Count of uploads and sessions not emitted because they were duplicates.",
+}, []string{"kind"})
+
+// A dedupeEntry records something that was emitted: either an
+// upload, keyed by the hash of its content, or a session, keyed by
+// its sessionId and launchDuration, with the hash of its line.
+type dedupeEntry struct {
+	Key  string `json:"key"`
+	Hash string `json:"hash,omitempty"`
+}
+
+// A dedupeCache remembers the most recently emitted uploads and
+// sessions, so that Adobe clients retrying an upload (which they
+// often do) don't cause the same data to be emitted twice. When
+// it's full, the least recently seen entries are forgotten.
+//
+// A dedupeCache is shared by all the trackers with the same
+// destination, so its state survives a config reload. If it has
+// a path, its entries are saved there when it's destructed (that
+// is, when Caddy stops) and loaded from there when it's created.
+type dedupeCache struct {
+	path string
+	size int
+
+	mu      sync.Mutex
+	order   *list.List // of dedupeEntry, most recently seen first
+	entries map[string]*list.Element
+}
+
+var dedupeCaches = caddy.NewUsagePool()
+
+// loadDedupeCache returns the shared cache for the given key,
+// creating it if necessary, and sets its size (so a config reload
+// that changes the size resizes the cache). Each call must be
+// matched by a call to releaseDedupeCache.
+func loadDedupeCache(key string, size int, path string) (*dedupeCache, error) {
+	value, _, err := dedupeCaches.LoadOrNew(key, func() (caddy.Destructor, error) {
+		return openDedupeCache(size, path)
+	})
+	if err != nil {
+		return nil, err
+	}
+	c := value.(*dedupeCache)
+	c.resize(size)
+	return c, nil
+}
+
+func releaseDedupeCache(key string) error {
+	_, err := dedupeCaches.Delete(key)
+	return err
+}
+
+func newDedupeCache(size int) *dedupeCache {
+	if size <= 0 {
+		size = defaultDedupeSize
+	}
+	return &dedupeCache{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// openDedupeCache creates a cache, loading its entries from path
+// (if given). A missing file is empty, and lines that can't be
+// decoded are skipped.
+func openDedupeCache(size int, path string) (*dedupeCache, error) {
+	c := newDedupeCache(size)
+	c.path = path
+	if path == "" {
+		return c, nil
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read dedupe file: %v", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry dedupeEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.Key == "" {
+			continue
+		}
+		c.remember([]dedupeEntry{entry})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read dedupe file: %v", err)
+	}
+	return c, nil
+}
+
+// Destruct implements caddy.Destructor.
+func (c *dedupeCache) Destruct() error {
+	return c.save()
+}
+
+// save atomically replaces the cache's file (if any) with
+// its entries, least recently seen first.
+func (c *dedupeCache) save() error {
+	if c.path == "" {
+		return nil
+	}
+	c.mu.Lock()
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for e := c.order.Back(); e != nil; e = e.Prev() {
+		if err := enc.Encode(e.Value.(dedupeEntry)); err != nil {
+			c.mu.Unlock()
+			return err
+		}
+	}
+	c.mu.Unlock()
+	temp := c.path + ".tmp"
+	if err := os.WriteFile(temp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, c.path)
+}
+
+// seen reports whether the entry is in the cache with the same
+// hash, and if so marks it as the most recently seen.
+func (c *dedupeCache) seen(entry dedupeEntry) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[entry.Key]
+	if !ok || e.Value.(dedupeEntry).Hash != entry.Hash {
+		return false
+	}
+	c.order.MoveToFront(e)
+	return true
+}
+
+// remember adds the entries to the cache (replacing any with
+// the same keys), forgetting the least recently seen entries
+// if that makes the cache too big.
+func (c *dedupeCache) remember(entries []dedupeEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, entry := range entries {
+		if e, ok := c.entries[entry.Key]; ok {
+			e.Value = entry
+			c.order.MoveToFront(e)
+			continue
+		}
+		c.entries[entry.Key] = c.order.PushFront(entry)
+		c.trim()
+	}
+}
+
+// resize changes the number of entries the cache keeps, forgetting
+// the least recently seen entries if it now has too many.
+func (c *dedupeCache) resize(size int) {
+	if size <= 0 {
+		size = defaultDedupeSize
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.size = size
+	c.trim()
+}
+
+// trim forgets the least recently seen entries until the cache
+// is no bigger than its size. It must be called with the lock held.
+func (c *dedupeCache) trim() {
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		delete(c.entries, oldest.Value.(dedupeEntry).Key)
+		c.order.Remove(oldest)
+	}
+}
+
+// filter checks an upload and the sessions parsed from it against
+// the cache. If the upload's content has been emitted before, it
+// reports a duplicate. Otherwise, it returns the sessions that
+// haven't been emitted with identical data, and the entries to
+// remember once they have been.
+func (c *dedupeCache) filter(body []byte, sessions []logSession, logger *zap.Logger) (fresh []logSession, entries []dedupeEntry, duplicate bool) {
+	sum := sha256.Sum256(body)
+	upload := dedupeEntry{Key: "upload|" + hex.EncodeToString(sum[:])}
+	if c.seen(upload) {
+		duplicatesFound.WithLabelValues(duplicateUpload).Inc()
+		return nil, nil, true
+	}
+	entries = append(entries, upload)
+	for _, s := range sessions {
+		lineSum := sha256.Sum256([]byte(sessionLine(s, zap.NewNop())))
+		entry := dedupeEntry{
+			Key:  fmt.Sprintf("session|%s|%d", s.sessionId, s.launchDuration.Milliseconds()),
+			Hash: hex.EncodeToString(lineSum[:]),
+		}
+		if c.seen(entry) {
+			duplicatesFound.WithLabelValues(duplicateSession).Inc()
+			logger.Debug("AdobeUsageTracker: skipping duplicate session", zap.Object("session", s))
+			continue
+		}
+		fresh = append(fresh, s)
+		entries = append(entries, entry)
+	}
+	return fresh, entries, false
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap/zaptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDedupeCacheEvicts(t *testing.T) {
+	c := newDedupeCache(2)
+	c.remember([]dedupeEntry{{Key: "a"}, {Key: "b", Hash: "1"}})
+	if !c.seen(dedupeEntry{Key: "a"}) || c.seen(dedupeEntry{Key: "b", Hash: "2"}) {
+		t.Errorf("Expected a hit on a and a miss on a different hash of b")
+	}
+	// a was seen more recently than b, so b is forgotten
+	c.remember([]dedupeEntry{{Key: "c"}})
+	if !c.seen(dedupeEntry{Key: "a"}) || c.seen(dedupeEntry{Key: "b", Hash: "1"}) || !c.seen(dedupeEntry{Key: "c"}) {
+		t.Errorf("Expected b to be evicted, got %d entries", len(c.entries))
+	}
+}
+
+func TestDedupeFilter(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	uploads := testutil.ToFloat64(duplicatesFound.WithLabelValues(duplicateUpload))
+	sessions := testutil.ToFloat64(duplicatesFound.WithLabelValues(duplicateSession))
+	buf, err := os.ReadFile("testdata/indesign-multi-session-1-2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed := parseLog(string(buf), "10.0.0.1")
+	c := newDedupeCache(0)
+	fresh, entries, duplicate := c.filter(buf, parsed, logger)
+	if duplicate || len(fresh) != 2 || len(entries) != 3 {
+		t.Fatalf("Expected 2 fresh sessions and 3 entries, got %d and %d", len(fresh), len(entries))
+	}
+	c.remember(entries)
+	if _, _, duplicate := c.filter(buf, parsed, logger); !duplicate {
+		t.Errorf("Expected a duplicate upload")
+	}
+	// the same sessions in a different upload are duplicates,
+	// unless their data has changed
+	changed := append([]logSession(nil), parsed...)
+	changed[1].uploaderVersion = "1.37.0.8"
+	fresh, entries, duplicate = c.filter(append(buf, '\n'), changed, logger)
+	if duplicate || len(fresh) != 1 || fresh[0].sessionId != parsed[1].sessionId || len(entries) != 2 {
+		t.Errorf("Expected only the changed session to be fresh, got %d", len(fresh))
+	}
+	if n := testutil.ToFloat64(duplicatesFound.WithLabelValues(duplicateUpload)) - uploads; n != 1 {
+		t.Errorf("Expected 1 duplicate upload counted, got %v", n)
+	}
+	if n := testutil.ToFloat64(duplicatesFound.WithLabelValues(duplicateSession)) - sessions; n != 1 {
+		t.Errorf("Expected 1 duplicate session counted, got %v", n)
+	}
+}
+
+func TestDedupeCachePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedupe.jsonl")
+	c, err := loadDedupeCache("persist", 2, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.remember([]dedupeEntry{{Key: "a"}, {Key: "b", Hash: "1"}, {Key: "c", Hash: "2"}})
+	if err := releaseDedupeCache("persist"); err != nil {
+		t.Fatal(err)
+	}
+	c, err = loadDedupeCache("persist", 2, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = releaseDedupeCache("persist") }()
+	if c.seen(dedupeEntry{Key: "a"}) || !c.seen(dedupeEntry{Key: "b", Hash: "1"}) || !c.seen(dedupeEntry{Key: "c", Hash: "2"}) {
+		t.Errorf("Expected the two most recent entries to be reloaded, got %d entries", len(c.entries))
+	}
+}
+
+func TestDedupeSuppressesRetries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dry-run.txt")
+	store := filepath.Join(t.TempDir(), "sessions.jsonl")
+	m := &AdobeUsageTracker{DryRun: true, DryRunFile: path, Dedupe: 100, SessionStore: store, Header: "X-Forwarded-For", Position: "first"}
+	if err := m.Provision(caddy.Context{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	defer func() { _ = m.Cleanup() }()
+	serveLog(t, m, "indesign-multi-session-1-2.txt")
+	serveLog(t, m, "indesign-multi-session-1-2.txt")
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(buf)), "\n"); len(lines) != 3 {
+		t.Errorf("Expected the retried upload to be suppressed, got:\n%s", buf)
+	}
+	if r := m.stats.report(); r.DupUploads != 1 || r.Requests != 2 || r.SessionsParsed != 2 {
+		t.Errorf("Expected 1 duplicate of 2 requests, got %+v", r)
+	}
+	// the duplicate's sessions are not stored again
+	if err := m.store.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := os.ReadFile(store); err != nil || strings.Count(string(buf), "\n") != 2 {
+		t.Errorf("Expected only the first upload's sessions to be stored, got %q (%v)", buf, err)
+	}
+}
+
+func TestDedupeCacheResizes(t *testing.T) {
+	c, err := loadDedupeCache("resize", 3, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = releaseDedupeCache("resize") }()
+	c.remember([]dedupeEntry{{Key: "a"}, {Key: "b"}, {Key: "c"}})
+	// a reload with a smaller size shrinks the shared cache
+	if c, err = loadDedupeCache("resize", 2, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = releaseDedupeCache("resize") }()
+	if c.size != 2 || len(c.entries) != 2 || c.seen(dedupeEntry{Key: "a"}) {
+		t.Errorf("Expected the cache to be resized to 2, got %d entries", len(c.entries))
+	}
+}
+
+func TestDedupeCaddyfile(t *testing.T) {
+	var m AdobeUsageTracker
+	if err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`adobe_usage_tracker {
+		dedupe
+	}`)); err != nil || m.Dedupe != defaultDedupeSize {
+		t.Errorf("Expected bare dedupe, got %+v (%v)", m, err)
+	}
+	m = AdobeUsageTracker{}
+	if err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`adobe_usage_tracker {
+		dedupe 500
+		dedupe_file /tmp/dedupe.jsonl
+	}`)); err != nil || m.Dedupe != 500 || m.DedupeFile != "/tmp/dedupe.jsonl" {
+		t.Errorf("Unexpected config: %+v (%v)", m, err)
+	}
+	m = AdobeUsageTracker{DryRun: true, DedupeFile: "/tmp/dedupe.jsonl", Position: "first"}
+	if err := m.Provision(caddy.Context{}); err == nil {
+		t.Errorf("Expected dedupe_file without dedupe to fail")
+	}
+}
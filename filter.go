@@ -0,0 +1,150 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// A requestFilter decides which requests the tracker tries to parse
+// logs from. Requests it rejects are passed to the next handler
+// without their bodies being read. An empty list of paths or
+// content types accepts any path or content type, and a zero
+// maximum length means there is no maximum.
+type requestFilter struct {
+	methods      []string // upper case, or "*" for any method
+	paths        []string // lower case
+	contentTypes []string // lower case, may end in "/*"
+	minLength    int64
+	maxLength    int64
+}
+
+func newRequestFilter(methods, paths, contentTypes []string, minLength, maxLength int64) (*requestFilter, error) {
+	if minLength < 0 || maxLength < 0 {
+		return nil, fmt.Errorf("content lengths cannot be negative")
+	}
+	if maxLength > 0 && minLength > maxLength {
+		return nil, fmt.Errorf("min_length %d is greater than max_length %d", minLength, maxLength)
+	}
+	f := &requestFilter{minLength: minLength, maxLength: maxLength}
+	if len(methods) == 0 {
+		methods = []string{http.MethodPost}
+	}
+	for _, method := range methods {
+		f.methods = append(f.methods, strings.ToUpper(method))
+	}
+	for _, path := range paths {
+		if !strings.HasPrefix(path, "/") && !strings.HasPrefix(path, "*") {
+			return nil, fmt.Errorf("path %q must start with / or *", path)
+		}
+		f.paths = append(f.paths, strings.ToLower(path))
+	}
+	for _, contentType := range contentTypes {
+		if !strings.Contains(contentType, "/") {
+			return nil, fmt.Errorf("content type %q must be of the form type/subtype", contentType)
+		}
+		f.contentTypes = append(f.contentTypes, strings.ToLower(contentType))
+	}
+	return f, nil
+}
+
+// accepts reports whether the tracker should try to parse the
+// request. If not, it also returns the reason, for logging. A
+// request whose length isn't known is not rejected by length
+// here, but by readBody once its body has been read.
+func (f *requestFilter) accepts(r *http.Request) (bool, string) {
+	if !slices.Contains(f.methods, "*") && !slices.Contains(f.methods, r.Method) {
+		return false, "method"
+	}
+	if len(f.paths) > 0 && !slices.ContainsFunc(f.paths, func(pattern string) bool {
+		return matchPath(pattern, strings.ToLower(r.URL.Path))
+	}) {
+		return false, "path"
+	}
+	if len(f.contentTypes) > 0 {
+		contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || !slices.ContainsFunc(f.contentTypes, func(pattern string) bool {
+			return matchContentType(pattern, contentType)
+		}) {
+			return false, "content type"
+		}
+	}
+	if r.ContentLength >= 0 {
+		if r.ContentLength < f.minLength {
+			return false, "content length"
+		}
+		if f.maxLength > 0 && r.ContentLength > f.maxLength {
+			return false, "content length"
+		}
+	}
+	return true, ""
+}
+
+// readBody reads the request's body, unless it turns out to be
+// shorter than the minimum length or longer than the maximum length
+// (which can only happen if its length wasn't known), in which case
+// it reports false and leaves the request's body intact for the
+// next handler.
+func (f *requestFilter) readBody(r *http.Request) ([]byte, bool, error) {
+	if r.ContentLength >= 0 {
+		buf, err := io.ReadAll(r.Body)
+		return buf, true, err
+	}
+	body := r.Body
+	if f.maxLength > 0 {
+		body = io.NopCloser(io.LimitReader(r.Body, f.maxLength+1))
+	}
+	buf, err := io.ReadAll(body)
+	if err != nil {
+		return nil, false, err
+	}
+	length := int64(len(buf))
+	if length >= f.minLength && (f.maxLength == 0 || length <= f.maxLength) {
+		return buf, true, nil
+	}
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+	return nil, false, nil
+}
+
+// matchPath reports whether the path matches the pattern, which
+// (as in Caddy's path matcher) is an exact path, a prefix ending
+// in "*", a suffix starting with "*", or a substring between two
+// "*"s. Both are expected to be in lower case.
+func matchPath(pattern, path string) bool {
+	switch {
+	case pattern == "*":
+		return true
+	case len(pattern) > 2 && strings.HasPrefix(pattern, "*") && strings.HasSuffix(pattern, "*"):
+		return strings.Contains(path, pattern[1:len(pattern)-1])
+	case strings.HasSuffix(pattern, "*"):
+		return strings.HasPrefix(path, pattern[:len(pattern)-1])
+	case strings.HasPrefix(pattern, "*"):
+		return strings.HasSuffix(path, pattern[1:])
+	default:
+		return path == pattern
+	}
+}
+
+// matchContentType reports whether the media type matches the
+// pattern, which is either a media type or a type followed by
+// "/*" (such as "text/*").
+func matchContentType(pattern, mediaType string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(mediaType, prefix)
+	}
+	return mediaType == pattern
+}
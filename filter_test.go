@@ -0,0 +1,159 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestFilterAccepts(t *testing.T) {
+	f, err := newRequestFilter(nil, []string{"/ulecs/*", "*.log"}, []string{"application/json", "text/*"}, 10, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		method, path, contentType string
+		length                    int64
+		reason                    string
+	}{
+		{http.MethodPost, "/ulecs/v1", "application/json; charset=utf-8", 50, ""},
+		{http.MethodPost, "/ULECS/v1", "text/plain", -1, ""},
+		{http.MethodPost, "/upload/NGLClient.log", "text/plain", 10, ""},
+		{http.MethodGet, "/ulecs/v1", "application/json", 50, "method"},
+		{http.MethodPost, "/ulecs", "application/json", 50, "path"},
+		{http.MethodPost, "/ulecs/v1", "image/png", 50, "content type"},
+		{http.MethodPost, "/ulecs/v1", "", 50, "content type"},
+		{http.MethodPost, "/ulecs/v1", "text/plain", 9, "content length"},
+		{http.MethodPost, "/ulecs/v1", "text/plain", 101, "content length"},
+	} {
+		r := httptest.NewRequest(tc.method, tc.path, nil)
+		r.Header.Set("Content-Type", tc.contentType)
+		r.ContentLength = tc.length
+		if ok, reason := f.accepts(r); ok != (tc.reason == "") || reason != tc.reason {
+			t.Errorf("%s %s (%s, %d): expected reason %q, got %q", tc.method, tc.path, tc.contentType, tc.length, tc.reason, reason)
+		}
+	}
+	if f, err = newRequestFilter([]string{"*"}, nil, nil, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := f.accepts(httptest.NewRequest(http.MethodPut, "/", nil)); !ok {
+		t.Errorf("Expected * to accept any method")
+	}
+	if _, err := newRequestFilter(nil, []string{"ulecs"}, nil, 0, 0); err == nil {
+		t.Errorf("Expected relative path to be rejected")
+	}
+	if _, err := newRequestFilter(nil, nil, []string{"text"}, 0, 0); err == nil {
+		t.Errorf("Expected content type without subtype to be rejected")
+	}
+	if _, err := newRequestFilter(nil, nil, nil, 100, 10); err == nil {
+		t.Errorf("Expected min_length above max_length to be rejected")
+	}
+}
+
+func TestRequestFilterReadBody(t *testing.T) {
+	f, err := newRequestFilter(nil, nil, nil, 6, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"short", "just right", "longer than ten bytes"} {
+		r := httptest.NewRequest(http.MethodPost, "/", io.NopCloser(strings.NewReader(body)))
+		r.ContentLength = -1
+		buf, ok, err := f.readBody(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != (body == "just right") {
+			t.Errorf("%q: expected read to be %t", body, body == "just right")
+		}
+		if ok && string(buf) != body {
+			t.Errorf("Expected body %q, got %q", body, buf)
+		}
+		if !ok {
+			if rest, err := io.ReadAll(r.Body); err != nil || string(rest) != body {
+				t.Errorf("Expected the intact body to be passed on, got %q (%v)", rest, err)
+			}
+		}
+	}
+}
+
+func TestFilteredRequestsPassThrough(t *testing.T) {
+	m := &AdobeUsageTracker{DryRun: true, Header: "X-Forwarded-For", Position: "first"}
+	if err := m.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = m.Cleanup() }()
+	req := httptest.NewRequest(http.MethodGet, "/ulecs/v1", strings.NewReader("not a log"))
+	called := false
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		called = true
+		if body, err := io.ReadAll(r.Body); err != nil || string(body) != "not a log" {
+			t.Errorf("Next handler did not get the intact body (%v)", err)
+		}
+		return nil
+	})
+	if err := m.ServeHTTP(httptest.NewRecorder(), req, next); err != nil {
+		t.Fatal(err)
+	}
+	if r := m.stats.report(); !called || r.Requests != 0 || r.SkippedRequests != 1 {
+		t.Errorf("Expected a skipped request passed to next, got %+v", r)
+	}
+}
+
+func TestShortUnknownLengthPassesThrough(t *testing.T) {
+	m := &AdobeUsageTracker{DryRun: true, MinLength: 100, Header: "X-Forwarded-For", Position: "first"}
+	if err := m.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = m.Cleanup() }()
+	req := httptest.NewRequest(http.MethodPost, "/ulecs/v1", strings.NewReader("not a log"))
+	req.ContentLength = -1
+	called := false
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		called = true
+		if body, err := io.ReadAll(r.Body); err != nil || string(body) != "not a log" {
+			t.Errorf("Next handler did not get the intact body (%v)", err)
+		}
+		return nil
+	})
+	if err := m.ServeHTTP(httptest.NewRecorder(), req, next); err != nil {
+		t.Fatal(err)
+	}
+	if r := m.stats.report(); !called || r.Requests != 0 || r.SkippedRequests != 1 {
+		t.Errorf("Expected a short chunked request to be skipped, got %+v", r)
+	}
+}
+
+func TestRequestFilterCaddyfile(t *testing.T) {
+	var m AdobeUsageTracker
+	d := caddyfile.NewTestDispenser(`adobe_usage_tracker {
+		methods POST PUT
+		paths /ulecs/*
+		content_types application/json text/*
+		min_length 1
+		max_length 50MB
+	}`)
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile failed: %v", err)
+	}
+	if strings.Join(m.Methods, " ") != "POST PUT" || strings.Join(m.Paths, " ") != "/ulecs/*" ||
+		strings.Join(m.ContentTypes, " ") != "application/json text/*" || m.MinLength != 1 || m.MaxLength != 50000000 {
+		t.Errorf("Unexpected config: %+v", m)
+	}
+	m = AdobeUsageTracker{}
+	if err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`adobe_usage_tracker {
+		max_length lots
+	}`)); err == nil {
+		t.Errorf("Expected an invalid max_length to fail")
+	}
+}
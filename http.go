@@ -0,0 +1,163 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var httpRegexMap = map[string]*regexp.Regexp{
+	"execute":  regexp.MustCompile(`^ExecuteRequest: request id: (\d+) api: (\d+)`),
+	"result":   regexp.MustCompile(`^(\w+): request (\d+) returned status (-?\d+)`),
+	"endpoint": regexp.MustCompile(`Calling endpoint (\S+)`),
+	"id":       regexp.MustCompile(`X-Request-Id: (\S+)`),
+	"code":     regexp.MustCompile(`(?:HttpResponseCode: |Received )(\d{3})\b`),
+}
+
+// An httpCall is a licensing-related network call made by NGL,
+// reconstructed from the log: the NGL request number and api id
+// from its ExecuteRequest line, the call name (e.g., GetProfile) and
+// NGL status from its result line, and, from the lines logged by the
+// worker thread that made the call, the endpoint it called, the HTTP
+// status it got, and the X-Request-Id that Adobe gave it.
+type httpCall struct {
+	request    int
+	api        int // -1 if the ExecuteRequest line wasn't seen
+	name       string
+	status     int
+	httpStatus int // 0 if unknown
+	endpoint   string
+	xRequestId string
+	start      time.Time // zero if the ExecuteRequest line wasn't seen
+	end        time.Time
+}
+
+// An httpThreadState is what a worker thread has logged about
+// the network call it's making, and when it last logged.
+type httpThreadState struct {
+	endpoint   string
+	httpStatus int
+	xRequestId string
+	updated    time.Time
+}
+
+// An httpTracker reconstructs the calls in a session as its log
+// lines are parsed.
+type httpTracker struct {
+	started map[int]httpCall
+	threads map[string]*httpThreadState
+	calls   []httpCall
+}
+
+func newHttpTracker() *httpTracker {
+	return &httpTracker{started: make(map[int]httpCall), threads: make(map[string]*httpThreadState)}
+}
+
+// add processes a log line written by thread at time t.
+func (h *httpTracker) add(thread string, t time.Time, description string) {
+	if match := httpRegexMap["execute"].FindStringSubmatch(description); match != nil {
+		request, _ := strconv.Atoi(match[1])
+		api, _ := strconv.Atoi(match[2])
+		h.started[request] = httpCall{request: request, api: api, start: t}
+		return
+	}
+	if match := httpRegexMap["result"].FindStringSubmatch(description); match != nil {
+		request, _ := strconv.Atoi(match[2])
+		status, _ := strconv.Atoi(match[3])
+		call, ok := h.started[request]
+		if ok {
+			delete(h.started, request)
+		} else {
+			call = httpCall{request: request, api: -1}
+		}
+		call.name, call.status, call.end = match[1], status, t
+		if worker := h.worker(thread, call.start); worker != "" {
+			state := h.threads[worker]
+			call.endpoint, call.httpStatus, call.xRequestId = state.endpoint, state.httpStatus, state.xRequestId
+			delete(h.threads, worker)
+		}
+		h.calls = append(h.calls, call)
+		return
+	}
+	state := h.threads[thread]
+	if state == nil {
+		state = &httpThreadState{}
+	}
+	if match := httpRegexMap["endpoint"].FindStringSubmatch(description); match != nil {
+		// a new call on this thread
+		state = &httpThreadState{endpoint: match[1]}
+	} else if match := httpRegexMap["id"].FindStringSubmatch(description); match != nil {
+		state.xRequestId = match[1]
+	} else if match := httpRegexMap["code"].FindStringSubmatch(description); match != nil {
+		state.httpStatus, _ = strconv.Atoi(match[1])
+	} else {
+		return
+	}
+	state.updated = t
+	h.threads[thread] = state
+}
+
+// worker returns the thread whose state describes the call whose
+// result was logged by the given thread. That's usually the same
+// thread, but the results of COPS calls (which are the ones with an
+// X-Request-Id) are logged by a controller thread, so for those we
+// use the worker that most recently logged since the call started.
+func (h *httpTracker) worker(thread string, start time.Time) string {
+	if _, ok := h.threads[thread]; ok {
+		return thread
+	}
+	if start.IsZero() {
+		return ""
+	}
+	var worker string
+	var latest time.Time
+	for id, state := range h.threads {
+		if state.xRequestId != "" && !state.updated.Before(start) && state.updated.After(latest) {
+			worker, latest = id, state.updated
+		}
+	}
+	return worker
+}
+
+// httpCallLines constructs a session-http line for each network call
+// in the session, timestamped when the call's result was logged.
+// The elapsed time is only known if the call's start was logged.
+func httpCallLines(s logSession) []string {
+	var lines []string
+	for _, c := range s.httpCalls {
+		if c.end.IsZero() {
+			continue
+		}
+		tags := fmt.Sprintf(",sessionId=%s,request=%d,call=%s", s.sessionId, c.request, escapeTag(c.name))
+		fields := fmt.Sprintf("status=%di", c.status)
+		if c.api >= 0 {
+			fields += fmt.Sprintf(",api=%di", c.api)
+		}
+		if !c.start.IsZero() {
+			fields += fmt.Sprintf(",elapsed=%di", c.end.Sub(c.start).Milliseconds())
+		}
+		if c.httpStatus != 0 {
+			fields += fmt.Sprintf(",httpStatus=%di", c.httpStatus)
+		}
+		if c.endpoint != "" {
+			if u, err := url.Parse(c.endpoint); err == nil && u.Host != "" {
+				tags += ",host=" + escapeTag(u.Host)
+			}
+			fields += fmt.Sprintf(",endpoint=%q", c.endpoint)
+		}
+		if c.xRequestId != "" {
+			fields += fmt.Sprintf(",xRequestId=%q", c.xRequestId)
+		}
+		lines = append(lines, fmt.Sprintf("session-http%s %s %d", tags, fields, c.end.UnixMilli()))
+	}
+	return lines
+}
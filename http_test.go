@@ -0,0 +1,84 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHttpCallsFromLog(t *testing.T) {
+	sessions := parseLogFile(t, "testdata/indesign-single-session-1.txt")
+	if len(sessions) != 1 {
+		t.Fatalf("Expected 1 session, got %d", len(sessions))
+	}
+	calls := make(map[int]httpCall)
+	for _, c := range sessions[0].httpCalls {
+		if _, ok := calls[c.request]; !ok {
+			calls[c.request] = c
+		}
+	}
+	cops := calls[2]
+	if cops.name != "GetProfile" || cops.api != 0 || cops.endpoint != "https://lcs-cops.adobe.io/asnp/nud/v4" ||
+		cops.xRequestId != "Req-Id-34dca967-b7ce-40ef-98fc-5588748fbebc" || cops.end.Sub(cops.start) != 7556*time.Millisecond {
+		t.Errorf("Unexpected COPS call: %+v", cops)
+	}
+	ims := calls[5]
+	if ims.name != "GetImsAccessToken" || ims.api != 2 || ims.httpStatus != 200 || ims.xRequestId != "" ||
+		!strings.Contains(ims.endpoint, "ims-prod06.adobelogin.com") {
+		t.Errorf("Unexpected IMS call: %+v", ims)
+	}
+	lines := httpCallLines(sessions[0])
+	if len(lines) != len(sessions[0].httpCalls) || !strings.HasPrefix(lines[0], "session-http,sessionId="+sessions[0].sessionId+
+		",request=2,call=GetProfile,host=lcs-cops.adobe.io status=0i,api=0i,elapsed=7556i,endpoint=") {
+		t.Errorf("Unexpected lines: %v", lines)
+	}
+}
+
+func TestHttpTracker(t *testing.T) {
+	start := time.Date(2024, 5, 30, 12, 0, 0, 0, time.UTC)
+	h := newHttpTracker()
+	h.add("1", start, "ExecuteRequest: request id: 7 api: 3 data?: yes workflow?: no")
+	h.add("2", start.Add(10*time.Millisecond), "SendHttpRequestSyncInternal: Calling endpoint https://lcs-cops.adobe.io/asnp/nud/v4")
+	h.add("2", start.Add(90*time.Millisecond), "FetchSPAndWorkflow: Received 204 in http request")
+	h.add("2", start.Add(95*time.Millisecond), "FetchSPAndWorkflow: X-Request-Id: Req-Id-1")
+	h.add("2", start.Add(100*time.Millisecond), "FetchSPAndWorkflow: request 7 returned status 12")
+	h.add("3", start.Add(time.Second), "GetProfile: request 4 returned status 0")
+	if len(h.calls) != 2 {
+		t.Fatalf("Expected 2 calls, got %+v", h.calls)
+	}
+	expected := httpCall{
+		request:    7,
+		api:        3,
+		name:       "FetchSPAndWorkflow",
+		status:     12,
+		httpStatus: 204,
+		endpoint:   "https://lcs-cops.adobe.io/asnp/nud/v4",
+		xRequestId: "Req-Id-1",
+		start:      start,
+		end:        start.Add(100 * time.Millisecond),
+	}
+	if h.calls[0] != expected {
+		t.Errorf("Expected %+v, got %+v", expected, h.calls[0])
+	}
+	lines := httpCallLines(logSession{sessionId: "s1", httpCalls: h.calls[1:]})
+	if len(lines) != 1 || lines[0] != "session-http,sessionId=s1,request=4,call=GetProfile status=0i 1717070401000" {
+		t.Errorf("Unexpected line for unstarted call: %v", lines)
+	}
+}
+
+func TestHttpCallsCaddyfile(t *testing.T) {
+	var m AdobeUsageTracker
+	d := caddyfile.NewTestDispenser(`adobe_usage_tracker {
+		http_calls
+	}`)
+	if err := m.UnmarshalCaddyfile(d); err != nil || !m.HttpCalls {
+		t.Errorf("Expected http_calls to be set (%v)", err)
+	}
+}
@@ -8,20 +8,31 @@
 package tracker
 
 import (
+	"encoding/json"
+	"fmt"
 	"go.uber.org/zap/zapcore"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
 var (
 	regexMap = map[string]*regexp.Regexp{
-		"line":   regexp.MustCompile(`SessionID=([^.]+\.([0-9]+)) Timestamp=([^ ]+) [^\r\n]*Description="([^\r\n]+)"`),
-		"os":     regexp.MustCompile(`SetConfig:.+OS Name=([^\s,]+), OS Version=([^\s,]+)`),
-		"app":    regexp.MustCompile(`SetConfig:.+AppID=([^,]+), AppVersion=([^\s,]+)`),
-		"ngl":    regexp.MustCompile(`SetConfig:.+NGLLibVersion=([^\s,]+)`),
-		"locale": regexp.MustCompile(`SetAppRuntimeConfig:.+AppLocale=([^\s,]+)`),
-		"user":   regexp.MustCompile(`LogCurrentUser:.+UserID=([^\s,]+)`),
+		"line":       regexp.MustCompile(`SessionID=([^.]+\.([0-9]+)) Timestamp=([^ ]+) ([^\r\n]*)Description="([^\r\n]+)"`),
+		"thread":     regexp.MustCompile(`ThreadID=(\S+)`),
+		"component":  regexp.MustCompile(`Component=(.+)$`),
+		"os":         regexp.MustCompile(`SetConfig:.+OS Name=([^,]+), OS Version=([^\s,]+)`),
+		"app":        regexp.MustCompile(`SetConfig:.+AppID=([^,]+), AppVersion=([^\s,]+)`),
+		"client":     regexp.MustCompile(`SetConfig:.+ClientID=([^\s,]+)`),
+		"ngl":        regexp.MustCompile(`SetConfig:.+NGLLibVersion=([^\s,]+)`),
+		"locale":     regexp.MustCompile(`SetAppRuntimeConfig:.+AppLocale=([^\s,]+)`),
+		"user":       regexp.MustCompile(`LogCurrentUser:.+UserID=([^\s,]+)`),
+		"initialize": regexp.MustCompile(`-------- Initializing session logs --------`),
+		"terminate": regexp.MustCompile(
+			`-------- Terminating session logs --------|^Shutdown :\s*Ingest manager shutdown`),
+		"timestamp": regexp.MustCompile(
+			`^(\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2})(?:([:.])(\d{1,3}))?(Z|[+-]\d{2}:?\d{2})?$`),
 	}
 )
 
@@ -42,61 +53,360 @@ var (
 // If a session's log gets split among multiple log files, this
 // means that later files will create sessions with bigger
 // launchDuration times.
+//
+// NGL stops logging once it has initialized, and only logs again
+// when the app exits, so the launchDuration is the app's actual
+// running time only if the log shows the session terminating.
+// The logInitialized and logTerminated fields record whether the
+// log's initialization and termination markers were seen, and the
+// lastSeen field is the time of the last log line.
+//
+// The product fields are derived from the appId (or clientId)
+// and appVersion, using a productTable.
 type logSession struct {
-	sessionId      string
-	launchTime     time.Time
-	launchDuration time.Duration
-	clientIp       string
-	appId          string // NGL app ID
-	appVersion     string
-	appLocale      string
-	nglVersion     string // version of the app's NGL library
-	osName         string
-	osVersion      string
-	userId         string // a SHA1 of the logged-in Adobe user ID
+	sessionId       string
+	launchTime      time.Time
+	launchDuration  time.Duration
+	lastSeen        time.Time
+	logInitialized  bool
+	logTerminated   bool
+	clientIp        string
+	appId           string // NGL app ID
+	appVersion      string
+	clientId        string // NGL client ID
+	appLocale       string
+	nglVersion      string // version of the app's NGL library
+	osName          string
+	osVersion       string
+	userId          string // a SHA1 of the logged-in Adobe user ID
+	uploaderVersion string // NGL version of the uploading client
+	profileSource   string // fetched, cached, prefetched, or offline
+	profileCache    string // status of reading the cached profile
+	refreshInterval time.Duration
+	asnpId          string // ID of the license profile (ASNP)
+	components      []componentActivity
+	httpCalls       []httpCall
+	product         string // human name of the app, such as "Photoshop"
+	productFamily   string // such as "Creative Cloud"
+	releaseYear     int    // year in the release name, such as 2024
 }
 
 func (l logSession) MarshalLogObject(enc zapcore.ObjectEncoder) error {
 	enc.AddString("sessionId", l.sessionId)
 	enc.AddString("launchTime", l.launchTime.Format(time.RFC3339))
 	enc.AddString("launchDuration", l.launchDuration.String())
+	enc.AddString("lastSeen", l.lastSeen.Format(time.RFC3339))
+	enc.AddBool("logInitialized", l.logInitialized)
+	enc.AddBool("logTerminated", l.logTerminated)
 	enc.AddString("clientIp", l.clientIp)
 	enc.AddString("appId", l.appId)
 	enc.AddString("appVersion", l.appVersion)
+	enc.AddString("clientId", l.clientId)
 	enc.AddString("appLocale", l.appLocale)
 	enc.AddString("nglVersion", l.nglVersion)
 	enc.AddString("osName", l.osName)
 	enc.AddString("osVersion", l.osVersion)
 	enc.AddString("userId", l.userId)
+	enc.AddString("uploaderVersion", l.uploaderVersion)
+	enc.AddString("profileSource", l.profileSource)
+	enc.AddString("profileCache", l.profileCache)
+	enc.AddDuration("refreshInterval", l.refreshInterval)
+	enc.AddString("asnpId", l.asnpId)
+	enc.AddString("product", l.product)
+	enc.AddString("productFamily", l.productFamily)
+	enc.AddInt("releaseYear", l.releaseYear)
+	return nil
+}
+
+// sessionJSON is the JSON form of a logSession.
+type sessionJSON struct {
+	SessionId       string `json:"sessionId"`
+	LaunchTime      string `json:"launchTime"`
+	LaunchDuration  int64  `json:"launchDuration"`
+	LastSeen        string `json:"lastSeen,omitempty"`
+	LogInitialized  bool   `json:"logInitialized,omitempty"`
+	LogTerminated   bool   `json:"logTerminated,omitempty"`
+	ClientIp        string `json:"clientIp"`
+	AppId           string `json:"appId,omitempty"`
+	AppVersion      string `json:"appVersion,omitempty"`
+	ClientId        string `json:"clientId,omitempty"`
+	AppLocale       string `json:"appLocale,omitempty"`
+	NglVersion      string `json:"nglVersion,omitempty"`
+	OsName          string `json:"osName,omitempty"`
+	OsVersion       string `json:"osVersion,omitempty"`
+	UserId          string `json:"userId,omitempty"`
+	UploaderVersion string `json:"uploaderVersion,omitempty"`
+	ProfileSource   string `json:"profileSource,omitempty"`
+	ProfileCache    string `json:"profileCache,omitempty"`
+	RefreshInterval int64  `json:"refreshInterval,omitempty"`
+	AsnpId          string `json:"asnpId,omitempty"`
+	Product         string `json:"product,omitempty"`
+	ProductFamily   string `json:"productFamily,omitempty"`
+	ReleaseYear     int    `json:"releaseYear,omitempty"`
+}
+
+// MarshalJSON encodes a logSession as JSON, with its launch
+// time in RFC3339 format and its launch duration in milliseconds
+// (just as they appear in the line protocol).
+func (l logSession) MarshalJSON() ([]byte, error) {
+	var lastSeen string
+	if !l.lastSeen.IsZero() {
+		lastSeen = l.lastSeen.UTC().Format(time.RFC3339Nano)
+	}
+	return json.Marshal(sessionJSON{
+		SessionId:       l.sessionId,
+		LaunchTime:      l.launchTime.UTC().Format(time.RFC3339Nano),
+		LaunchDuration:  l.launchDuration.Milliseconds(),
+		LastSeen:        lastSeen,
+		LogInitialized:  l.logInitialized,
+		LogTerminated:   l.logTerminated,
+		ClientIp:        l.clientIp,
+		AppId:           l.appId,
+		AppVersion:      l.appVersion,
+		ClientId:        l.clientId,
+		AppLocale:       l.appLocale,
+		NglVersion:      l.nglVersion,
+		OsName:          l.osName,
+		OsVersion:       l.osVersion,
+		UserId:          l.userId,
+		UploaderVersion: l.uploaderVersion,
+		ProfileSource:   l.profileSource,
+		ProfileCache:    l.profileCache,
+		RefreshInterval: l.refreshInterval.Milliseconds(),
+		AsnpId:          l.asnpId,
+		Product:         l.product,
+		ProductFamily:   l.productFamily,
+		ReleaseYear:     l.releaseYear,
+	})
+}
+
+// UnmarshalJSON decodes a logSession from the JSON produced
+// by MarshalJSON.
+func (l *logSession) UnmarshalJSON(data []byte) error {
+	var j sessionJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	launchTime, err := time.Parse(time.RFC3339Nano, j.LaunchTime)
+	if err != nil {
+		return err
+	}
+	var lastSeen time.Time
+	if j.LastSeen != "" {
+		if lastSeen, err = time.Parse(time.RFC3339Nano, j.LastSeen); err != nil {
+			return err
+		}
+	}
+	*l = logSession{
+		sessionId:       j.SessionId,
+		launchTime:      launchTime,
+		launchDuration:  time.Duration(j.LaunchDuration) * time.Millisecond,
+		lastSeen:        lastSeen,
+		logInitialized:  j.LogInitialized,
+		logTerminated:   j.LogTerminated,
+		clientIp:        j.ClientIp,
+		appId:           j.AppId,
+		appVersion:      j.AppVersion,
+		clientId:        j.ClientId,
+		appLocale:       j.AppLocale,
+		nglVersion:      j.NglVersion,
+		osName:          j.OsName,
+		osVersion:       j.OsVersion,
+		userId:          j.UserId,
+		uploaderVersion: j.UploaderVersion,
+		profileSource:   j.ProfileSource,
+		profileCache:    j.ProfileCache,
+		refreshInterval: time.Duration(j.RefreshInterval) * time.Millisecond,
+		asnpId:          j.AsnpId,
+		product:         j.Product,
+		productFamily:   j.ProductFamily,
+		releaseYear:     j.ReleaseYear,
+	}
 	return nil
 }
 
 // parseLog reads every line of a log's contents, and returns
 // a slice of the logSessions found in the log.  It never fails,
 // but it will return an empty slice on malformed input.
-func parseLog(log string, ip string) (sessions []logSession) {
+func parseLog(log string, ip string) []logSession {
+	sessions, _ := parseLogReport(log, ip)
+	return sessions
+}
+
+// A parseReport describes how well a log matched the formats
+// the parser knows about, so that changes to those formats by
+// Adobe show up as a drop in quality rather than silently as a
+// drop in sessions. Sessions missing an app, OS, or user are
+// usually fragments of a split log, but a rise in their number
+// suggests that one of the description formats has changed.
+type parseReport struct {
+	TotalLines     int `json:"totalLines"`
+	MatchedLines   int `json:"matchedLines"`
+	UnmatchedLines int `json:"unmatchedLines"`
+	Sessions       int `json:"sessions"`
+	MissingAppId   int `json:"missingAppId"`
+	MissingOsName  int `json:"missingOsName"`
+	MissingUserId  int `json:"missingUserId"`
+	BadTimestamps  int `json:"badTimestamps"`
+}
+
+// add accumulates the counts of another report into r.
+func (r *parseReport) add(o parseReport) {
+	r.TotalLines += o.TotalLines
+	r.MatchedLines += o.MatchedLines
+	r.UnmatchedLines += o.UnmatchedLines
+	r.Sessions += o.Sessions
+	r.MissingAppId += o.MissingAppId
+	r.MissingOsName += o.MissingOsName
+	r.MissingUserId += o.MissingUserId
+	r.BadTimestamps += o.BadTimestamps
+}
+
+// parseLogReport is parseLog, but it also returns a report on
+// the quality of the parse. Blank lines are not counted.
+func parseLogReport(log string, ip string) (sessions []logSession, report parseReport) {
 	var session logSession
 	var lastTime time.Time
+	var timeline componentTimeline
+	var calls *httpTracker
 	endSession := func() {
 		if session.sessionId != "" {
 			if lastTime.Compare(session.launchTime) > 0 {
 				session.launchDuration = lastTime.Sub(session.launchTime)
 			}
+			session.lastSeen = lastTime
+			if !lastTime.IsZero() && lastTime.Before(session.launchTime) {
+				// the log's clock was behind the one that
+				// made the sessionId, so use the launch time
+				session.lastSeen = session.launchTime
+			}
+			session.components = timeline.activities()
+			session.httpCalls = calls.calls
+			builtinProducts.apply(&session)
 			sessions = append(sessions, session)
+			report.Sessions++
+			if session.appId == "" {
+				report.MissingAppId++
+			}
+			if session.osName == "" {
+				report.MissingOsName++
+			}
+			if session.userId == "" {
+				report.MissingUserId++
+			}
 		}
 	}
-	for _, line := range regexMap["line"].FindAllStringSubmatch(log, -1) {
+	for _, text := range strings.Split(log, "\n") {
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		report.TotalLines++
+		line := regexMap["line"].FindStringSubmatch(text)
+		if line == nil {
+			report.UnmatchedLines++
+			continue
+		}
+		report.MatchedLines++
 		if sessionId := line[1]; sessionId != session.sessionId {
 			endSession()
+			lastTime = time.Time{}
 			session = logSession{sessionId: sessionId, launchTime: parseTimeMillis(line[2]), clientIp: ip}
+			timeline = make(componentTimeline)
+			calls = newHttpTracker()
+		}
+		t := parseLogTimestamp(line[3])
+		if t.Equal(time.UnixMilli(0)) {
+			report.BadTimestamps++
+			t = time.Time{}
+		} else {
+			lastTime = t
 		}
-		lastTime = parseLogTimestamp(line[3])
-		parseLogDescription(line[4], &session)
+		thread := lineAttribute("thread", line[4])
+		timeline.add(lineAttribute("component", line[4]), thread, t)
+		calls.add(thread, t, line[5])
+		parseLogDescription(line[5], &session)
 	}
 	endSession()
 	return
 }
 
+// fromNgl reports whether any of the log was in NGL format, so that
+// its quality is worth uploading. Bodies with no NGL lines at all
+// (such as other requests that pass the tracker's filter) are not
+// reported, so they don't each cost an Influx write.
+func (r parseReport) fromNgl() bool {
+	return r.MatchedLines > 0 || r.Sessions > 0
+}
+
+// qualityLine constructs a line protocol line for a parse report
+// on a log uploaded from the given client at the given time.
+func qualityLine(r parseReport, clientIp string, received time.Time) string {
+	return fmt.Sprintf("parse-quality totalLines=%di,matchedLines=%di,unmatchedLines=%di,"+
+		"sessions=%di,missingAppId=%di,missingOsName=%di,missingUserId=%di,badTimestamps=%di,clientIp=%q %d",
+		r.TotalLines, r.MatchedLines, r.UnmatchedLines,
+		r.Sessions, r.MissingAppId, r.MissingOsName, r.MissingUserId, r.BadTimestamps,
+		clientIp, received.UnixMilli())
+}
+
+// lineAttribute returns the value of the named attribute (thread
+// or component) from the attributes between a line's timestamp
+// and its description, or the empty string if it's missing.
+func lineAttribute(name, attributes string) string {
+	if match := regexMap[name].FindStringSubmatch(strings.TrimSpace(attributes)); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
+// mergeSession combines two logSessions with the same sessionId,
+// such as those found in different files of a split log. The
+// result has the longer of the two launch durations, and any
+// fields missing from that session are filled in from the other.
+// It is complete if either of them saw the log's markers.
+func mergeSession(a, b logSession) logSession {
+	if b.launchDuration > a.launchDuration {
+		a, b = b, a
+	}
+	if b.lastSeen.After(a.lastSeen) {
+		a.lastSeen = b.lastSeen
+	}
+	a.logInitialized = a.logInitialized || b.logInitialized
+	a.logTerminated = a.logTerminated || b.logTerminated
+	fill := func(field *string, other string) {
+		if *field == "" {
+			*field = other
+		}
+	}
+	fill(&a.clientIp, b.clientIp)
+	if a.appId == "" {
+		a.appId, a.appVersion = b.appId, b.appVersion
+	}
+	fill(&a.clientId, b.clientId)
+	if a.product == "" {
+		a.product, a.productFamily, a.releaseYear = b.product, b.productFamily, b.releaseYear
+	}
+	fill(&a.appLocale, b.appLocale)
+	fill(&a.nglVersion, b.nglVersion)
+	if a.osName == "" {
+		a.osName, a.osVersion = b.osName, b.osVersion
+	}
+	fill(&a.userId, b.userId)
+	fill(&a.uploaderVersion, b.uploaderVersion)
+	fill(&a.profileSource, b.profileSource)
+	fill(&a.profileCache, b.profileCache)
+	fill(&a.asnpId, b.asnpId)
+	if a.refreshInterval == 0 {
+		a.refreshInterval = b.refreshInterval
+	}
+	if len(a.components) == 0 {
+		a.components = b.components
+	}
+	if len(a.httpCalls) == 0 {
+		a.httpCalls = b.httpCalls
+	}
+	return a
+}
+
 // parseLogDescription takes the description field of a log line and
 // fills session parameters from values found in the description.
 func parseLogDescription(description string, session *logSession) {
@@ -107,12 +417,21 @@ func parseLogDescription(description string, session *logSession) {
 	} else if match = regexMap["app"].FindStringSubmatch(description); match != nil {
 		session.appId = match[1]
 		session.appVersion = match[2]
+		if match = regexMap["client"].FindStringSubmatch(description); match != nil {
+			session.clientId = match[1]
+		}
 	} else if match = regexMap["ngl"].FindStringSubmatch(description); match != nil {
 		session.nglVersion = match[1]
 	} else if match = regexMap["locale"].FindStringSubmatch(description); match != nil {
 		session.appLocale = match[1]
 	} else if match = regexMap["user"].FindStringSubmatch(description); match != nil {
 		session.userId = match[1]
+	} else if regexMap["initialize"].MatchString(description) {
+		session.logInitialized = true
+	} else if regexMap["terminate"].MatchString(description) {
+		session.logTerminated = true
+	} else {
+		parseProfileDescription(description, session)
 	}
 }
 
@@ -128,21 +447,33 @@ func parseTimeMillis(s string) time.Time {
 	return time.UnixMilli(msec)
 }
 
-// parseLogTiimestamp is given a date string in the unique format
-// written by Adobe apps in their log, and returns a time.Time
-// containing that value. If it's given malformed input, it
-// returns the epoch.
+// parseLogTimestamp parses an NGL log timestamp. On Mac, these
+// look like "2024-02-15T10:54:21:732-0800", with the milliseconds
+// after a colon. Windows logs vary: the milliseconds may have
+// fewer than three digits (they are a count, not a fraction, so
+// ":7" is 7ms), may follow a period (".7" is a fraction, 700ms),
+// or may be missing, and the zone may be "Z", "+hh:mm", "+hhmm",
+// or missing (meaning UTC). Timestamps that can't be parsed are
+// returned as the Unix epoch.
 func parseLogTimestamp(s string) time.Time {
-	// incoming format is "2024-02-15T10:54:21:732-0800"
-	// but we have to replace that last : with a . to get it to parse.
-	// Luckily, it's at a fixed offset in the timestring
-	if s[19] != ':' {
+	match := regexMap["timestamp"].FindStringSubmatch(strings.TrimSpace(s))
+	if match == nil {
 		return time.UnixMilli(0)
 	}
-	valid := s[0:19] + "." + s[20:]
-	t, err := time.Parse("2006-01-02T15:04:05.999-0700", valid)
+	zone := strings.Replace(match[4], ":", "", 1)
+	if zone == "" {
+		zone = "Z"
+	}
+	t, err := time.Parse("2006-01-02T15:04:05Z0700", match[1]+zone)
 	if err != nil {
 		return time.UnixMilli(0)
 	}
+	if millis := match[3]; millis != "" {
+		if match[2] == "." {
+			millis = (millis + "00")[:3]
+		}
+		n, _ := strconv.Atoi(millis)
+		t = t.Add(time.Duration(n) * time.Millisecond)
+	}
 	return t
 }
@@ -7,10 +7,14 @@
 package tracker
 
 import (
+	"encoding/json"
 	"fmt"
+	"go.uber.org/zap"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseSingleSessionLogs(t *testing.T) {
@@ -153,3 +157,162 @@ func TestParseLatestLogs(t *testing.T) {
 		}
 	}
 }
+
+func TestParseWindowsLogs(t *testing.T) {
+	for _, c := range []struct {
+		file, appId, osVersion, locale string
+		duration                       time.Duration
+	}{
+		{"testdata/windows-photoshop-session.txt", "Photoshop1", "10.0.22631", "en_IN", 4*time.Minute + 39*time.Second + 3*time.Millisecond},
+		{"testdata/windows-illustrator-session.txt", "Illustrator1", "10.0.19045", "en_US", 12*time.Minute + 30*time.Second + 500*time.Millisecond},
+	} {
+		buffer, err := os.ReadFile(c.file)
+		if err != nil {
+			t.Fatalf("Failed to read file %s: %s", c.file, err)
+		}
+		if !strings.Contains(string(buffer), "\r\n") {
+			t.Fatalf("Expected CRLF line endings in %s", c.file)
+		}
+		sessions := parseLog(string(buffer), "127.0.0.1:53450")
+		if len(sessions) != 1 {
+			t.Fatalf("%s: expected 1 session, got %d", c.file, len(sessions))
+		}
+		s := sessions[0]
+		if s.appId != c.appId || s.osName != "WIN" || s.osVersion != c.osVersion || s.appLocale != c.locale {
+			t.Errorf("%s: unexpected session %+v", c.file, s)
+		}
+		if s.userId != "4b0c2a1e9d7f63e8a5b1c0d2e3f4a5b6c7d8e9f0" {
+			t.Errorf("%s: unexpected userId %q", c.file, s.userId)
+		}
+		if s.launchDuration != c.duration {
+			t.Errorf("%s: expected duration %v, got %v", c.file, c.duration, s.launchDuration)
+		}
+	}
+}
+
+func TestParseLogTimestamp(t *testing.T) {
+	for s, expected := range map[string]string{
+		"2024-02-15T10:54:21:732-0800":   "2024-02-15T18:54:21.732Z",
+		"2024-02-15T10:54:21:7-0800":     "2024-02-15T18:54:21.007Z",
+		"2024-02-15T10:54:21:73+05:30":   "2024-02-15T05:24:21.073Z",
+		"2024-02-15T10:54:21.7Z":         "2024-02-15T10:54:21.7Z",
+		"2024-02-15T10:54:21.73Z":        "2024-02-15T10:54:21.73Z",
+		"2024-02-15T10:54:21Z":           "2024-02-15T10:54:21Z",
+		"2024-02-15T10:54:21":            "2024-02-15T10:54:21Z",
+		"2024-02-15T10:54:21:732-0800\r": "2024-02-15T18:54:21.732Z",
+	} {
+		if got := parseLogTimestamp(s).UTC().Format(time.RFC3339Nano); got != expected {
+			t.Errorf("parseLogTimestamp(%q): expected %s, got %s", s, expected, got)
+		}
+	}
+	for _, s := range []string{"", "2024", "2024-02-15T10:54", "2024-02-15T10:54:21:7320-0800", "2024-02-15T10:54:21+0800junk"} {
+		if got := parseLogTimestamp(s); !got.Equal(time.UnixMilli(0)) {
+			t.Errorf("parseLogTimestamp(%q): expected the epoch, got %v", s, got)
+		}
+	}
+}
+
+func TestParseReport(t *testing.T) {
+	buffer, err := os.ReadFile("testdata/windows-photoshop-session.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := "garbage line\r\n\r\n" + string(buffer) + "SessionID=truncated\n"
+	sessions, report := parseLogReport(log, "127.0.0.1:53450")
+	expected := parseReport{
+		TotalLines:     13,
+		MatchedLines:   11,
+		UnmatchedLines: 2,
+		Sessions:       1,
+		BadTimestamps:  1,
+	}
+	if len(sessions) != 1 || report != expected {
+		t.Errorf("Expected report %+v, got %+v", expected, report)
+	}
+	fragment := strings.Join(strings.Split(log, "\r\n")[9:], "\n")
+	_, report = parseLogReport(fragment, "127.0.0.1:53450")
+	if report.Sessions != 1 || report.MissingAppId != 1 || report.MissingOsName != 1 || report.MissingUserId != 0 {
+		t.Errorf("Expected a fragment missing app and OS, got %+v", report)
+	}
+	line := qualityLine(report, "10.0.0.1", time.UnixMilli(1717081583006))
+	if !strings.HasPrefix(line, "parse-quality totalLines=") || !strings.HasSuffix(line, `,clientIp="10.0.0.1" 1717081583006`) {
+		t.Errorf("Unexpected quality line: %s", line)
+	}
+}
+
+func TestParseSessionCompleteness(t *testing.T) {
+	tests := []struct {
+		path                    string
+		initialized, terminated bool
+	}{
+		{"testdata/indesign-single-session-1.txt", true, true},
+		{"testdata/indesign-split-session-1-1.txt", true, false},
+		{"testdata/indesign-split-session-1-2.txt", false, true},
+		{"testdata/NGLClient_Illustrator126.5.3.log", true, false},
+		{"testdata/windows-photoshop-session.txt", true, true},
+	}
+	for _, tc := range tests {
+		s := parseLogFile(t, tc.path)[0]
+		if s.logInitialized != tc.initialized || s.logTerminated != tc.terminated {
+			t.Errorf("%s: expected initialized=%t, terminated=%t, got %t, %t",
+				tc.path, tc.initialized, tc.terminated, s.logInitialized, s.logTerminated)
+		}
+		if !s.lastSeen.Equal(s.launchTime.Add(s.launchDuration)) {
+			t.Errorf("%s: last seen %v is not launch time plus duration", tc.path, s.lastSeen)
+		}
+		if line := sessionLine(s, zap.NewNop()); !strings.Contains(line, fmt.Sprintf(
+			",sessionComplete=%t,lastSeen=%di", tc.terminated, s.lastSeen.UnixMilli())) {
+			t.Errorf("%s: unexpected line: %s", tc.path, line)
+		}
+	}
+	first := parseLogFile(t, "testdata/indesign-split-session-1-1.txt")[0]
+	second := parseLogFile(t, "testdata/indesign-split-session-1-2.txt")[0]
+	merged := mergeSession(first, second)
+	if !merged.logInitialized || !merged.logTerminated || !merged.lastSeen.Equal(second.lastSeen) {
+		t.Errorf("Unexpected merge of split session: %+v", merged)
+	}
+	buf, err := json.Marshal(merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var copied logSession
+	if err := json.Unmarshal(buf, &copied); err != nil {
+		t.Fatal(err)
+	}
+	if !copied.logInitialized || !copied.logTerminated || !copied.lastSeen.Equal(merged.lastSeen) {
+		t.Errorf("Expected completeness to survive JSON, got %+v", copied)
+	}
+}
+
+func TestParseTerminateBeforeLaunch(t *testing.T) {
+	// launched at 18:02:15.643 by its sessionId, terminated at 18:00 by its timestamp
+	log := `SessionID=1ffe79ab-258a-4ad0-ad0b-14f7718ea7f5.1710291735643 Timestamp=2024-03-12T18:00:00:000-0700 ` +
+		`ThreadID=3100654 Component=ngl-lib_NglAppLib Description="-------- Terminating session logs --------"`
+	sessions := parseLog(log, "10.0.0.1")
+	if len(sessions) != 1 {
+		t.Fatalf("Expected 1 session, got %d", len(sessions))
+	}
+	s := sessions[0]
+	if !s.logTerminated || s.launchDuration != 0 || !s.lastSeen.Equal(s.launchTime) {
+		t.Errorf("Expected last seen clamped to launch time %v, got %v", s.launchTime, s.lastSeen)
+	}
+}
+
+func TestParseSplitSessionTailOnly(t *testing.T) {
+	head := parseLogFile(t, "testdata/indesign-split-session-1-1.txt")[0]
+	tail := parseLogFile(t, "testdata/indesign-split-session-1-2.txt")[0]
+	// the tail alone has a termination marker, but its start was lost
+	line := sessionLine(tail, zap.NewNop())
+	if !strings.Contains(line, ",sessionComplete=true") || strings.Contains(line, "logInitialized") {
+		t.Errorf("Expected a terminated session without an initialized start: %s", line)
+	}
+	// the head's point has the start, which the tail's point doesn't overwrite
+	if line := sessionLine(head, zap.NewNop()); !strings.Contains(line, ",sessionComplete=false") ||
+		!strings.Contains(line, ",logInitialized=true") {
+		t.Errorf("Expected an initialized session that isn't complete: %s", line)
+	}
+	if line := sessionLine(mergeSession(head, tail), zap.NewNop()); !strings.Contains(line, ",sessionComplete=true") ||
+		!strings.Contains(line, ",logInitialized=true") {
+		t.Errorf("Expected the merged session to be initialized and complete: %s", line)
+	}
+}
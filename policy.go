@@ -0,0 +1,311 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDedupWindow = 24 * time.Hour
+	webhookTimeout     = 10 * time.Second
+)
+
+// A VersionPolicy specifies the minimum versions of apps (by
+// appId), of the NGL library, and of operating systems (by osName)
+// that are allowed. When a launch that violates the policy is seen,
+// an alert is posted to the webhook URL, in one of three formats:
+// generic (JSON describing the violation), slack, or teams.
+//
+// Alerts are deduplicated: once an alert has been posted about a
+// user (or, if no user was logged in, a client) running a given
+// version, no more are posted about that for DedupWindow.
+type VersionPolicy struct {
+	MinAppVersions map[string]string `json:"min_app_versions,omitempty"`
+	MinNglVersion  string            `json:"min_ngl_version,omitempty"`
+	MinOsVersions  map[string]string `json:"min_os_versions,omitempty"`
+	WebhookURL     string            `json:"webhook_url,omitempty"`
+	WebhookFormat  string            `json:"webhook_format,omitempty"`
+	DedupWindow    caddy.Duration    `json:"dedup_window,omitempty"`
+
+	url    string
+	window time.Duration
+	mins   map[string]version // keyed by kind and subject
+	client *http.Client
+	now    func() time.Time
+
+	mu   sync.Mutex
+	sent map[string]time.Time
+}
+
+// A versionViolation describes a launch below a minimum version.
+type versionViolation struct {
+	Kind    string `json:"kind"`    // app, ngl, or os
+	Subject string `json:"subject"` // the appId, "NGL", or the osName
+	Version string `json:"version"`
+	Minimum string `json:"minimum"`
+}
+
+// provision validates the policy and resolves any global
+// placeholders in the webhook URL (which is often a secret).
+func (p *VersionPolicy) provision() error {
+	if p.WebhookURL == "" {
+		return fmt.Errorf("version_policy requires a webhook URL")
+	}
+	target, err := resolvePlaceholders(caddy.NewReplacer(), "webhook", p.WebhookURL)
+	if err != nil {
+		return err
+	}
+	if u, err := url.Parse(target); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("invalid webhook URL %q", target)
+	}
+	p.url = target
+	switch p.WebhookFormat {
+	case "":
+		p.WebhookFormat = "generic"
+	case "generic", "slack", "teams":
+	default:
+		return fmt.Errorf("webhook format must be generic, slack, or teams, not %q", p.WebhookFormat)
+	}
+	minimums := map[string]string{minimumKey("ngl", "NGL"): p.MinNglVersion}
+	for appId, v := range p.MinAppVersions {
+		minimums[minimumKey("app", appId)] = v
+	}
+	for osName, v := range p.MinOsVersions {
+		minimums[minimumKey("os", osName)] = v
+	}
+	p.mins = make(map[string]version)
+	for subject, v := range minimums {
+		if v == "" {
+			continue
+		}
+		if !validVersion(v) {
+			_, subject, _ = strings.Cut(subject, "|")
+			return fmt.Errorf("invalid minimum version %q for %s", v, subject)
+		}
+		p.mins[subject], _ = parseVersion(v)
+	}
+	p.window = time.Duration(p.DedupWindow)
+	if p.window == 0 {
+		p.window = defaultDedupWindow
+	}
+	p.client = &http.Client{Timeout: webhookTimeout}
+	p.now = time.Now
+	p.sent = make(map[string]time.Time)
+	return nil
+}
+
+// violations returns the ways in which a session violates the policy.
+func (p *VersionPolicy) violations(s logSession) []versionViolation {
+	var result []versionViolation
+	check := func(kind, subject, found, minimum string) {
+		least, ok := p.mins[minimumKey(kind, subject)]
+		if !ok {
+			return
+		}
+		if v, ok := parseVersion(found); ok && v.compare(least) < 0 {
+			result = append(result, versionViolation{Kind: kind, Subject: subject, Version: found, Minimum: minimum})
+		}
+	}
+	check("app", s.appId, s.appVersion, p.MinAppVersions[s.appId])
+	check("ngl", "NGL", s.nglVersion, p.MinNglVersion)
+	check("os", s.osName, s.osVersion, p.MinOsVersions[s.osName])
+	return result
+}
+
+// minimumKey is the key of a minimum version in the parsed minimums.
+func minimumKey(kind, subject string) string {
+	return kind + "|" + subject
+}
+
+// A versionAlert is a violation found in a session that is
+// to be posted to the webhook.
+type versionAlert struct {
+	session   logSession
+	violation versionViolation
+}
+
+// check posts an alert for each violation in the given sessions
+// that hasn't already been alerted within the dedup window.
+func (p *VersionPolicy) check(sessions []logSession, logger *zap.Logger) {
+	p.send(p.alerts(sessions), logger)
+}
+
+// alerts records and returns the violations in the given sessions
+// that haven't already been alerted within the dedup window. It
+// does no I/O, so the alerts can be sent (by send) in the background.
+func (p *VersionPolicy) alerts(sessions []logSession) []versionAlert {
+	var alerts []versionAlert
+	for _, s := range sessions {
+		for _, v := range p.violations(s) {
+			if p.shouldAlert(s, v) {
+				alerts = append(alerts, versionAlert{s, v})
+			}
+		}
+	}
+	return alerts
+}
+
+// send posts the given alerts to the webhook.
+func (p *VersionPolicy) send(alerts []versionAlert, logger *zap.Logger) {
+	for _, a := range alerts {
+		if err := p.post(a.session, a.violation); err != nil {
+			logger.Error("AdobeUsageTracker: failed to post version alert",
+				zap.String("subject", a.violation.Subject), zap.String("version", a.violation.Version), zap.Error(err))
+		}
+	}
+}
+
+// forget removes the record of the given alerts, which weren't
+// sent, so that later launches with the same violation alert again.
+func (p *VersionPolicy) forget(alerts []versionAlert) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, a := range alerts {
+		delete(p.sent, alertKey(a.session, a.violation))
+	}
+}
+
+// shouldAlert records an alert about the violation for the session's
+// user (or client) unless one was already recorded in the window.
+func (p *VersionPolicy) shouldAlert(s logSession, v versionViolation) bool {
+	key := alertKey(s, v)
+	now := p.now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if last, ok := p.sent[key]; ok && now.Sub(last) < p.window {
+		return false
+	}
+	for k, last := range p.sent {
+		if now.Sub(last) >= p.window {
+			delete(p.sent, k)
+		}
+	}
+	p.sent[key] = now
+	return true
+}
+
+// alertKey identifies alerts about the violation for the
+// session's user (or, if no user was logged in, its client).
+func alertKey(s logSession, v versionViolation) string {
+	who := s.userId
+	if who == "" {
+		who = "client:" + s.clientIp
+	}
+	return strings.Join([]string{who, v.Kind, v.Subject, v.Version}, "|")
+}
+
+// post sends an alert about the violation to the webhook.
+func (p *VersionPolicy) post(s logSession, v versionViolation) error {
+	body, err := json.Marshal(webhookPayload(p.WebhookFormat, s, v))
+	if err != nil {
+		return err
+	}
+	res, err := p.client.Post(p.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("webhook status code: %d: %s", res.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// webhookPayload returns the alert payload in the given format.
+func webhookPayload(format string, s logSession, v versionViolation) any {
+	who := "user " + s.userId
+	if s.userId == "" {
+		who = "a user"
+	}
+	what := v.Subject + " " + v.Version
+	if v.Kind == "ngl" {
+		what = fmt.Sprintf("%s (%s %s)", what, s.appId, s.appVersion)
+	}
+	text := fmt.Sprintf("Outdated version: %s launched %s (minimum %s) from %s at %s",
+		who, what, v.Minimum, s.clientIp, s.launchTime.UTC().Format(time.RFC3339))
+	switch format {
+	case "slack":
+		return map[string]any{"text": text}
+	case "teams":
+		return map[string]any{
+			"@type":      "MessageCard",
+			"@context":   "https://schema.org/extensions",
+			"summary":    "Outdated " + v.Subject + " version",
+			"themeColor": "D70000",
+			"title":      "Outdated " + v.Subject + " version",
+			"text":       text,
+		}
+	default:
+		return map[string]any{
+			"event":     "outdated_version",
+			"violation": v,
+			"session":   s,
+		}
+	}
+}
+
+// unmarshalVersionPolicy parses a version_policy block:
+//
+//	version_policy {
+//	    min_app_version <appId> <version>
+//	    min_ngl_version <version>
+//	    min_os_version <osName> <version>
+//	    webhook <url> [generic|slack|teams]
+//	    dedup_window <duration>
+//	}
+func unmarshalVersionPolicy(d *caddyfile.Dispenser) (*VersionPolicy, error) {
+	p := &VersionPolicy{}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		key := d.Val()
+		args := d.RemainingArgs()
+		switch {
+		case key == "min_app_version" && len(args) == 2:
+			if p.MinAppVersions == nil {
+				p.MinAppVersions = make(map[string]string)
+			}
+			p.MinAppVersions[args[0]] = args[1]
+		case key == "min_ngl_version" && len(args) == 1:
+			p.MinNglVersion = args[0]
+		case key == "min_os_version" && len(args) == 2:
+			if p.MinOsVersions == nil {
+				p.MinOsVersions = make(map[string]string)
+			}
+			p.MinOsVersions[args[0]] = args[1]
+		case key == "webhook" && (len(args) == 1 || len(args) == 2):
+			p.WebhookURL = args[0]
+			if len(args) == 2 {
+				p.WebhookFormat = args[1]
+			}
+		case key == "dedup_window" && len(args) == 1:
+			dur, err := caddy.ParseDuration(args[0])
+			if err != nil {
+				return nil, d.Errf("invalid dedup_window %q: %v", args[0], err)
+			}
+			p.DedupWindow = caddy.Duration(dur)
+		default:
+			return nil, d.ArgErr()
+		}
+	}
+	return p, nil
+}
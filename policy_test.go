@@ -0,0 +1,151 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"encoding/json"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap/zaptest"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookServer returns a test server that records the
+// payloads posted to it, and a function that returns them.
+func webhookServer(t *testing.T) (*httptest.Server, func() []map[string]any) {
+	var mu sync.Mutex
+	var payloads []map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var payload map[string]any
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("Invalid webhook payload: %v", err)
+		}
+		mu.Lock()
+		payloads = append(payloads, payload)
+		mu.Unlock()
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []map[string]any {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]map[string]any(nil), payloads...)
+	}
+}
+
+func TestVersionPolicyAlerts(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	server, payloads := webhookServer(t)
+	p := &VersionPolicy{
+		MinAppVersions: map[string]string{"Photoshop1": "25.9"},
+		MinNglVersion:  "1.35",
+		MinOsVersions:  map[string]string{"MAC": "13"},
+		WebhookURL:     server.URL,
+		DedupWindow:    0,
+	}
+	if err := p.provision(); err != nil {
+		t.Fatalf("provision failed: %v", err)
+	}
+	now := time.Date(2024, 5, 30, 12, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return now }
+	old := logSession{
+		sessionId:  "old",
+		appId:      "Photoshop1",
+		appVersion: "25.7.0",
+		nglVersion: "1.35.0.12",
+		osName:     "MAC",
+		osVersion:  "12.7.4",
+		userId:     "alice",
+		clientIp:   "10.0.0.1",
+	}
+	current := old
+	current.appVersion, current.osVersion = "25.9.0", "14.5.0"
+	if v := p.violations(current); len(v) != 0 {
+		t.Errorf("Expected no violations for current versions, got %+v", v)
+	}
+	p.check([]logSession{old, current, old}, logger)
+	got := payloads()
+	if len(got) != 2 {
+		t.Fatalf("Expected app and os alerts once each, got %v", got)
+	}
+	violation := got[0]["violation"].(map[string]any)
+	if got[0]["event"] != "outdated_version" || violation["subject"] != "Photoshop1" || violation["minimum"] != "25.9" {
+		t.Errorf("Unexpected generic payload: %v", got[0])
+	}
+	// another user gets their own alert, and the window expires
+	bob := old
+	bob.userId = "bob"
+	p.check([]logSession{bob}, logger)
+	now = now.Add(defaultDedupWindow)
+	p.check([]logSession{old}, logger)
+	if got := payloads(); len(got) != 6 {
+		t.Errorf("Expected 6 alerts after new user and window expiry, got %d", len(got))
+	}
+}
+
+func TestWebhookPayloadFormats(t *testing.T) {
+	s := logSession{appId: "Photoshop1", appVersion: "25.7.0", clientIp: "10.0.0.1", userId: "alice"}
+	v := versionViolation{Kind: "app", Subject: "Photoshop1", Version: "25.7.0", Minimum: "25.9"}
+	slack := webhookPayload("slack", s, v).(map[string]any)
+	if text := slack["text"].(string); !strings.Contains(text, "alice launched Photoshop1 25.7.0 (minimum 25.9)") {
+		t.Errorf("Unexpected slack text: %s", text)
+	}
+	teams := webhookPayload("teams", s, v).(map[string]any)
+	if teams["@type"] != "MessageCard" || !strings.Contains(teams["text"].(string), "10.0.0.1") {
+		t.Errorf("Unexpected teams payload: %v", teams)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	for _, c := range []struct {
+		a, b     string
+		expected int
+	}{
+		{"25.9.0", "25.9", 0},
+		{"25.10", "25.9", 1},
+		{"24.2.20759.7", "24.2.20760", -1},
+		{"14.5.0", "13", 1},
+		{"10.0.19045", "10.0.22000", -1},
+		{"1.37.0.8b", "1.37.0.8", 0},
+	} {
+		if got := compareVersions(c.a, c.b); got != c.expected {
+			t.Errorf("compareVersions(%q, %q): expected %d, got %d", c.a, c.b, c.expected, got)
+		}
+	}
+}
+
+func TestVersionPolicyCaddyfile(t *testing.T) {
+	var m AdobeUsageTracker
+	d := caddyfile.NewTestDispenser(`adobe_usage_tracker {
+		version_policy {
+			min_app_version Photoshop1 25.9
+			min_os_version WIN 10.0.19045
+			min_ngl_version 1.35
+			webhook {env.ALERT_WEBHOOK} slack
+			dedup_window 12h
+		}
+		dry_run
+	}`)
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile failed: %v", err)
+	}
+	p := m.VersionPolicy
+	if p == nil || p.MinAppVersions["Photoshop1"] != "25.9" || p.MinOsVersions["WIN"] != "10.0.19045" ||
+		p.MinNglVersion != "1.35" || p.WebhookFormat != "slack" || time.Duration(p.DedupWindow) != 12*time.Hour || !m.DryRun {
+		t.Errorf("Unexpected config: %+v %+v", m, p)
+	}
+	p.MinNglVersion = "1.x"
+	t.Setenv("ALERT_WEBHOOK", "https://hooks.example.com/x")
+	if err := p.provision(); err == nil {
+		t.Errorf("Expected an error for an invalid minimum version")
+	}
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A ProductInfo describes the product that an NGL AppID or ClientID
+// belongs to: its human name, its product family (such as Creative
+// Cloud), and, for products whose releases are named by year, the
+// offset from the major version to the year (so that Photoshop 25.x,
+// with an offset of 1999, is "Photoshop 2024"). A zero offset means
+// the product's releases aren't named by year.
+type ProductInfo struct {
+	Name       string `json:"name"`
+	Family     string `json:"family"`
+	YearOffset int    `json:"year_offset,omitempty"`
+}
+
+// A productTable maps normalized AppIDs and ClientIDs to products.
+type productTable map[string]ProductInfo
+
+const (
+	creativeCloud = "Creative Cloud"
+	documentCloud = "Document Cloud"
+)
+
+// builtinProducts are the products that are known without any
+// configuration. Both the AppID (e.g., Photoshop1) and the ClientID
+// (e.g., ngl_photoshop1) of a product normalize to the same key.
+var builtinProducts = productTable{
+	"photoshop":         {"Photoshop", creativeCloud, 1999},
+	"illustrator":       {"Illustrator", creativeCloud, 1996},
+	"indesign":          {"InDesign", creativeCloud, 2005},
+	"incopy":            {"InCopy", creativeCloud, 2005},
+	"premierepro":       {"Premiere Pro", creativeCloud, 2000},
+	"aftereffects":      {"After Effects", creativeCloud, 2000},
+	"audition":          {"Audition", creativeCloud, 2000},
+	"mediaencoder":      {"Media Encoder", creativeCloud, 2000},
+	"animate":           {"Animate", creativeCloud, 2000},
+	"characteranimator": {"Character Animator", creativeCloud, 2000},
+	"dreamweaver":       {"Dreamweaver", creativeCloud, 2000},
+	"bridge":            {"Bridge", creativeCloud, 2010},
+	"lightroomclassic":  {"Lightroom Classic", creativeCloud, 0},
+	"acrobatdc":         {"Acrobat", documentCloud, 0},
+	"acrobat":           {"Acrobat", documentCloud, 0},
+}
+
+// newProductTable returns the builtin products extended (or
+// overridden) by the given products, which are keyed by AppID
+// or ClientID.
+func newProductTable(products map[string]ProductInfo) (productTable, error) {
+	table := make(productTable, len(builtinProducts)+len(products))
+	for key, info := range builtinProducts {
+		table[key] = info
+	}
+	for id, info := range products {
+		key := productKey(id)
+		if key == "" {
+			return nil, fmt.Errorf("invalid product id %q", id)
+		}
+		if info.Name == "" || info.Family == "" {
+			return nil, fmt.Errorf("product %s needs both a name and a family", id)
+		}
+		if info.YearOffset < 0 {
+			return nil, fmt.Errorf("product %s has a negative year offset", id)
+		}
+		table[key] = info
+	}
+	return table, nil
+}
+
+// productKey normalizes an AppID or ClientID: it's lower-cased, the
+// ngl_ prefix and any separators are removed, and so are the trailing
+// digits (which are the NGL app generation, not part of the name).
+func productKey(id string) string {
+	key := strings.TrimPrefix(strings.ToLower(id), "ngl_")
+	key = strings.NewReplacer("_", "", "-", "", " ", "").Replace(key)
+	return strings.TrimRight(key, "0123456789")
+}
+
+// lookup finds the product for the given AppID or, failing
+// that, ClientID.
+func (t productTable) lookup(appId, clientId string) (ProductInfo, bool) {
+	for _, id := range []string{appId, clientId} {
+		if id == "" {
+			continue
+		}
+		if info, ok := t[productKey(id)]; ok {
+			return info, true
+		}
+	}
+	return ProductInfo{}, false
+}
+
+// apply sets the product fields of the session from the table.
+// A session whose app isn't in the table has no product fields.
+func (t productTable) apply(s *logSession) {
+	info, ok := t.lookup(s.appId, s.clientId)
+	if !ok {
+		s.product, s.productFamily, s.releaseYear = "", "", 0
+		return
+	}
+	s.product, s.productFamily, s.releaseYear = info.Name, info.Family, 0
+	if v, ok := parseVersion(s.appVersion); ok && info.YearOffset > 0 && v.major > 0 {
+		s.releaseYear = info.YearOffset + v.major
+	}
+}
+
+// productName returns the release name of the session's product,
+// such as "Photoshop 2024", or just the product if it has no year.
+func (l *logSession) productName() string {
+	if l.releaseYear == 0 {
+		return l.product
+	}
+	return fmt.Sprintf("%s %d", l.product, l.releaseYear)
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap/zaptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestProductTagsFromTestdata(t *testing.T) {
+	expected := map[string]string{
+		"AcrobatDC1 24.2.20759.7": "Acrobat|Document Cloud|0",
+		"Illustrator1 26.5.3":     "Illustrator|Creative Cloud|2022",
+		"Illustrator1 28.5.0":     "Illustrator|Creative Cloud|2024",
+		"InDesign1 19.4":          "InDesign|Creative Cloud|2024",
+		"Photoshop1 25.9.0":       "Photoshop|Creative Cloud|2024",
+		"PremierePro1 22.6.4":     "Premiere Pro|Creative Cloud|2022",
+	}
+	seen := make(map[string]bool)
+	paths, err := filepath.Glob("testdata/NGLClient_*.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		for _, s := range parseLogFile(t, path) {
+			key := s.appId + " " + s.appVersion
+			want, ok := expected[key]
+			if !ok {
+				continue
+			}
+			seen[key] = true
+			if got := strings.Join([]string{s.product, s.productFamily, strconv.Itoa(s.releaseYear)}, "|"); got != want {
+				t.Errorf("%s: expected %s, got %s", key, want, got)
+			}
+			if s.clientId == "" {
+				t.Errorf("%s: expected a client ID", key)
+			}
+		}
+	}
+	if len(seen) != len(expected) {
+		t.Errorf("Expected all of %d apps in testdata, saw %v", len(expected), seen)
+	}
+}
+
+func TestProductLookup(t *testing.T) {
+	table, err := newProductTable(map[string]ProductInfo{
+		"Substance3DPainter1": {Name: "Substance 3D Painter", Family: "Substance 3D"},
+		"ngl_photoshop1":      {Name: "Photoshop (Beta)", Family: "Creative Cloud", YearOffset: 1999},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the client ID is used when the app ID is unknown
+	s := logSession{appId: "Unknown1", clientId: "ngl_premiere_pro1", appVersion: "24.4.1"}
+	table.apply(&s)
+	if s.productName() != "Premiere Pro 2024" || s.productFamily != "Creative Cloud" {
+		t.Errorf("Unexpected client ID product: %q %q", s.productName(), s.productFamily)
+	}
+	s = logSession{appId: "Substance3DPainter1", appVersion: "9.1.2"}
+	table.apply(&s)
+	if s.productName() != "Substance 3D Painter" || s.releaseYear != 0 {
+		t.Errorf("Unexpected custom product: %q %d", s.productName(), s.releaseYear)
+	}
+	s = logSession{appId: "Photoshop1", appVersion: "25.9.0"}
+	table.apply(&s)
+	if s.productName() != "Photoshop (Beta) 2024" {
+		t.Errorf("Expected override of builtin product, got %q", s.productName())
+	}
+	s.appId = "Mystery1"
+	table.apply(&s)
+	if s.product != "" || s.releaseYear != 0 {
+		t.Errorf("Expected no product for unknown app, got %+v", s)
+	}
+	if _, err := newProductTable(map[string]ProductInfo{"Foo1": {Name: "Foo"}}); err == nil {
+		t.Errorf("Expected an error for a product without a family")
+	}
+}
+
+func TestProductLineFields(t *testing.T) {
+	s := logSession{sessionId: "s1", appId: "PremierePro1", appVersion: "24.4.1", clientId: "ngl_premiere_pro1"}
+	builtinProducts.apply(&s)
+	line := sessionLine(s, zaptest.NewLogger(t))
+	fields := `,product="Premiere Pro",productName="Premiere Pro 2024",productFamily="Creative Cloud",releaseYear=2024i`
+	if !strings.HasPrefix(line, "log-session,sessionId=s1 ") || !strings.Contains(line, fields) ||
+		!strings.Contains(line, `,clientId="ngl_premiere_pro1"`) {
+		t.Errorf("Unexpected line: %s", line)
+	}
+}
+
+func TestProductSplitSessionSeries(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	first := parseLogFile(t, "testdata/indesign-split-session-1-1.txt")
+	second := parseLogFile(t, "testdata/indesign-split-session-1-2.txt")
+	if len(first) != 1 || len(second) != 1 {
+		t.Fatalf("Expected one session per fragment, got %d and %d", len(first), len(second))
+	}
+	if first[0].product == "" || second[0].product != "" {
+		t.Fatalf("Expected only the first fragment to have a product")
+	}
+	// the later fragment's point must overwrite the earlier one
+	firstLine, secondLine := sessionLines(first, logger)[0], sessionLines(second, logger)[0]
+	firstTags, _, _ := strings.Cut(firstLine, " ")
+	secondTags, _, _ := strings.Cut(secondLine, " ")
+	if firstTags != secondTags {
+		t.Errorf("Fragments are in different series: %q and %q", firstTags, secondTags)
+	}
+}
+
+func TestProductCaddyfile(t *testing.T) {
+	var m AdobeUsageTracker
+	d := caddyfile.NewTestDispenser(`adobe_usage_tracker {
+		product Substance3DPainter1 "Substance 3D Painter" "Substance 3D"
+		product Photoshop1 Photoshop "Creative Cloud" 1999
+	}`)
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile failed: %v", err)
+	}
+	if m.Products["Substance3DPainter1"].Family != "Substance 3D" || m.Products["Photoshop1"].YearOffset != 1999 {
+		t.Errorf("Unexpected products: %+v", m.Products)
+	}
+	d = caddyfile.NewTestDispenser(`adobe_usage_tracker {
+		product Photoshop1 Photoshop
+	}`)
+	if err := m.UnmarshalCaddyfile(d); err == nil {
+		t.Errorf("Expected an error for a product without a family")
+	}
+}
@@ -0,0 +1,66 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The sources of the license profile that a session ran with.
+const (
+	// profileFetched means a new profile was fetched from Adobe.
+	profileFetched = "fetched"
+	// profileCached means Adobe was asked for a new profile but said
+	// (with a no-content response) that the cached one is current.
+	profileCached = "cached"
+	// profilePrefetched means a profile prefetched earlier was used.
+	profilePrefetched = "prefetched"
+	// profileOffline means Adobe couldn't be asked, so the
+	// cached profile was used without being validated.
+	profileOffline = "offline"
+)
+
+var profileRegexMap = map[string]*regexp.Regexp{
+	"cache":     regexp.MustCompile(`^GetCachedNglProfile Status: ([^:]+)`),
+	"asnp":      regexp.MustCompile(`^GetCachedNglProfile ASNP ID: (\S+)`),
+	"refresh":   regexp.MustCompile(`Update refresh interval to (\d+)`),
+	"fetched":   regexp.MustCompile(`^ProcessAsnp : ASNP retrieval/validation from COPS succeeded|^ProcessV2Profile: handler succeeded`),
+	"noContent": regexp.MustCompile(`^ProcessV2Profile: .*NO CONTENT response from server`),
+	"fromCache": regexp.MustCompile(`^ProcessV2Profile: .*licensed from cache`),
+	"prefetch":  regexp.MustCompile(`^GetCachedProfile: Prefetched profile latest`),
+}
+
+// parseProfileDescription looks for information about the license
+// profile in a log line's description. When more than one line
+// gives the profile's source, the last one wins, because NGL logs
+// its attempts to use the cache before those to go online.
+func parseProfileDescription(description string, session *logSession) {
+	if match := profileRegexMap["cache"].FindStringSubmatch(description); match != nil {
+		session.profileCache = strings.TrimSpace(match[1])
+	} else if match := profileRegexMap["asnp"].FindStringSubmatch(description); match != nil {
+		session.asnpId = match[1]
+	} else if match := profileRegexMap["refresh"].FindStringSubmatch(description); match != nil {
+		if ms, err := strconv.ParseInt(match[1], 10, 64); err == nil {
+			session.refreshInterval = time.Duration(ms) * time.Millisecond
+		}
+	} else if profileRegexMap["fetched"].MatchString(description) {
+		session.profileSource = profileFetched
+	} else if profileRegexMap["noContent"].MatchString(description) {
+		session.profileSource = profileCached
+	} else if profileRegexMap["fromCache"].MatchString(description) {
+		// a no-content response also leads to licensing from cache
+		if session.profileSource != profileCached {
+			session.profileSource = profileOffline
+		}
+	} else if profileRegexMap["prefetch"].MatchString(description) {
+		session.profileSource = profilePrefetched
+	}
+}
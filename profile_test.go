@@ -0,0 +1,97 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"encoding/json"
+	"go.uber.org/zap/zaptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProfileFromTestdata(t *testing.T) {
+	tests := []struct {
+		path, source, cache string
+		refresh             time.Duration
+		asnpId              string
+	}{
+		{"testdata/indesign-single-session-1.txt", profileFetched, "Success", 87840 * time.Second, "e59a641b-0c10-4ca3-a7d9-0e2e92ff2c5a"},
+		{"testdata/indesign-single-session-2.txt", profileCached, "Success", 0, ""},
+		{"testdata/NGLClient_Photoshop123.5.5.log", profileFetched, "Data Not Found", 0, ""},
+		{"testdata/NGLClient_Photoshop125.9.0.log", profileCached, "Success", 0, ""},
+		{"testdata/windows-illustrator-session.txt", "", "", 0, ""},
+	}
+	for _, tc := range tests {
+		s := parseLogFile(t, tc.path)[0]
+		if s.profileSource != tc.source || s.profileCache != tc.cache {
+			t.Errorf("%s: expected source %q and cache %q, got %q and %q",
+				tc.path, tc.source, tc.cache, s.profileSource, s.profileCache)
+		}
+		if tc.refresh != 0 && s.refreshInterval != tc.refresh {
+			t.Errorf("%s: expected refresh interval %v, got %v", tc.path, tc.refresh, s.refreshInterval)
+		}
+		if tc.asnpId != "" && s.asnpId != tc.asnpId {
+			t.Errorf("%s: expected ASNP ID %s, got %s", tc.path, tc.asnpId, s.asnpId)
+		}
+	}
+}
+
+func TestProfileSources(t *testing.T) {
+	for expected, descriptions := range map[string][]string{
+		profileOffline: {
+			"GetCachedNglProfile Status: Success",
+			"ProcessV2Profile: Initial profile failure: licensed from cache (profile status 0)",
+		},
+		profileCached: {
+			"ProcessV2Profile: Initial profile fetch got NO CONTENT response from server, use cached profile",
+			"ProcessV2Profile: Initial profile failure: licensed from cache (profile status 0)",
+		},
+		profilePrefetched: {
+			"GetCachedNglProfile Status: Data Not Found : Cached NGL Profile",
+			"GetCachedProfile: Prefetched profile latest, using prefetched profile",
+		},
+		profileFetched: {
+			"GetCachedNglProfile Status: Data Not Found : Cached NGL Profile",
+			"ProcessAsnp : ASNP retrieval/validation from COPS succeeded",
+		},
+	} {
+		var s logSession
+		for _, d := range descriptions {
+			parseLogDescription(d, &s)
+		}
+		if s.profileSource != expected {
+			t.Errorf("Expected source %s from %v, got %q", expected, descriptions, s.profileSource)
+		}
+	}
+}
+
+func TestProfileFields(t *testing.T) {
+	s := logSession{
+		sessionId:       "s1",
+		launchTime:      time.UnixMilli(1716994039000),
+		profileSource:   profileOffline,
+		profileCache:    "Success",
+		refreshInterval: 85680 * time.Second,
+		asnpId:          "e59a641b",
+	}
+	line := sessionLine(s, zaptest.NewLogger(t))
+	if !strings.Contains(line, `,profileSource="offline",profileCache="Success",refreshInterval=85680000i,asnpId="e59a641b"`) {
+		t.Errorf("Unexpected line: %s", line)
+	}
+	buf, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var copied logSession
+	if err := json.Unmarshal(buf, &copied); err != nil {
+		t.Fatal(err)
+	}
+	if copied.profileSource != s.profileSource || copied.refreshInterval != s.refreshInterval || copied.asnpId != s.asnpId {
+		t.Errorf("Expected profile fields to survive JSON, got %+v", copied)
+	}
+}
@@ -0,0 +1,304 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultReportWindow   = "30d"
+	defaultInactiveDays   = 30
+	reportTimeFormat      = time.RFC3339
+	reportContentTypeCSV  = "text/csv; charset=utf-8"
+	reportContentTypeJSON = "application/json"
+)
+
+// reportParams specify the sessions covered by a report: the
+// usage counts cover launches in the window that ends at until,
+// and users are flagged as inactive if they have no launches in
+// the inactiveDays before until.
+type reportParams struct {
+	until        time.Time
+	window       time.Duration
+	inactiveDays int
+}
+
+// parseReportParams interprets the report parameters given as
+// strings (by CLI flags or URL query values). Empty values get
+// defaults: now, a 30-day window, and 30 inactive days.
+func parseReportParams(until, window, inactiveDays string, now time.Time) (reportParams, error) {
+	params := reportParams{until: now, inactiveDays: defaultInactiveDays}
+	if until != "" {
+		t, err := parseReplayTime(until)
+		if err != nil {
+			return params, err
+		}
+		params.until = t
+	}
+	if window == "" {
+		window = defaultReportWindow
+	}
+	d, err := caddy.ParseDuration(window)
+	if err != nil || d <= 0 {
+		return params, fmt.Errorf("invalid window %q: must be a positive duration such as 30d", window)
+	}
+	params.window = d
+	if inactiveDays != "" {
+		n, err := strconv.Atoi(inactiveDays)
+		if err != nil || n <= 0 {
+			return params, fmt.Errorf("invalid inactive days %q: must be a positive number", inactiveDays)
+		}
+		params.inactiveDays = n
+	}
+	return params, nil
+}
+
+// A usageReport summarizes each user's launches, so that licenses
+// assigned to users who aren't using them can be reclaimed.
+type usageReport struct {
+	Since        time.Time   `json:"since"`
+	Until        time.Time   `json:"until"`
+	InactiveDays int         `json:"inactiveDays"`
+	Users        []userUsage `json:"users"`
+}
+
+// A userUsage gives a user's last launch (of any app, at any time
+// before the end of the report) and their usage of each app during
+// the report window. Inactive users have no recent launches.
+type userUsage struct {
+	UserId     string     `json:"userId"`
+	LastLaunch time.Time  `json:"lastLaunch"`
+	Inactive   bool       `json:"inactive"`
+	Apps       []appUsage `json:"apps"`
+}
+
+// An appUsage gives a user's launch count and total launch
+// duration (in milliseconds) for an app during the report window,
+// and the newest version of the app they launched.
+type appUsage struct {
+	AppId         string    `json:"appId"`
+	LastLaunch    time.Time `json:"lastLaunch"`
+	Launches      int       `json:"launches"`
+	TotalDuration int64     `json:"totalDuration"`
+	LatestVersion string    `json:"latestVersion,omitempty"`
+}
+
+// buildUsageReport computes a usage report from the given sessions.
+// Sessions without a userId (because no one was logged in) are not
+// counted. Users are ordered by last launch, least recent first.
+func buildUsageReport(sessions []logSession, params reportParams) usageReport {
+	report := usageReport{
+		Since:        params.until.Add(-params.window).UTC(),
+		Until:        params.until.UTC(),
+		InactiveDays: params.inactiveDays,
+		Users:        []userUsage{},
+	}
+	inactiveBefore := params.until.AddDate(0, 0, -params.inactiveDays)
+	users := make(map[string]*userUsage)
+	apps := make(map[string]map[string]*appUsage)
+	for _, s := range sessions {
+		if s.userId == "" || !s.launchTime.Before(params.until) {
+			continue
+		}
+		user := users[s.userId]
+		if user == nil {
+			user = &userUsage{UserId: s.userId, Apps: []appUsage{}}
+			users[s.userId] = user
+			apps[s.userId] = make(map[string]*appUsage)
+		}
+		if s.launchTime.After(user.LastLaunch) {
+			user.LastLaunch = s.launchTime.UTC()
+		}
+		if s.launchTime.Before(report.Since) {
+			continue
+		}
+		app := apps[s.userId][s.appId]
+		if app == nil {
+			app = &appUsage{AppId: s.appId}
+			apps[s.userId][s.appId] = app
+		}
+		app.Launches++
+		app.TotalDuration += s.launchDuration.Milliseconds()
+		if s.launchTime.After(app.LastLaunch) {
+			app.LastLaunch = s.launchTime.UTC()
+		}
+		if s.appVersion != "" && compareVersions(s.appVersion, app.LatestVersion) > 0 {
+			app.LatestVersion = s.appVersion
+		}
+	}
+	for id, user := range users {
+		user.Inactive = user.LastLaunch.Before(inactiveBefore)
+		for _, app := range apps[id] {
+			user.Apps = append(user.Apps, *app)
+		}
+		sort.Slice(user.Apps, func(i, j int) bool { return user.Apps[i].AppId < user.Apps[j].AppId })
+		report.Users = append(report.Users, *user)
+	}
+	sort.Slice(report.Users, func(i, j int) bool {
+		a, b := report.Users[i], report.Users[j]
+		if !a.LastLaunch.Equal(b.LastLaunch) {
+			return a.LastLaunch.Before(b.LastLaunch)
+		}
+		return a.UserId < b.UserId
+	})
+	return report
+}
+
+// writeCSV writes the report with one row for each app used by
+// each user, or a single row (with no app) for a user who used
+// no apps during the report window.
+func (r usageReport) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"userId", "lastLaunch", "inactive", "appId", "appLastLaunch", "launches", "totalDurationMs", "latestVersion"})
+	for _, user := range r.Users {
+		prefix := []string{user.UserId, user.LastLaunch.Format(reportTimeFormat), strconv.FormatBool(user.Inactive)}
+		if len(user.Apps) == 0 {
+			_ = cw.Write(append(prefix, "", "", "0", "0", ""))
+		}
+		for _, app := range user.Apps {
+			_ = cw.Write(append(prefix,
+				app.AppId,
+				app.LastLaunch.Format(reportTimeFormat),
+				strconv.Itoa(app.Launches),
+				strconv.FormatInt(app.TotalDuration, 10),
+				app.LatestVersion,
+			))
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// write writes the report in the given format: csv or json.
+func (r usageReport) write(w io.Writer, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	}
+	return r.writeCSV(w)
+}
+
+func newReportCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "report --store <file> [--window <duration>] [--inactive-days <n>] [--until <time>] [--format csv|json]",
+		Short: "Report per-user license utilization from a session store",
+		Long: `
+Reports, for each user found in a tracker's session_store file,
+the date of their last launch, and the number of launches and total
+launch duration of each app they used during the report window
+(default 30d). Users with no launches in the last --inactive-days
+(default 30) are flagged as inactive, and users are listed least
+recently active first, so that unused licenses can be reclaimed.
+
+The report ends now, or at --until (an RFC 3339 time or a
+YYYY-MM-DD date). It is written as CSV (the default) or JSON.`,
+		Args: cobra.NoArgs,
+	}
+	cmd.Flags().String("store", "", "Session store file kept by a tracker")
+	cmd.Flags().String("window", defaultReportWindow, "Period of usage to report")
+	cmd.Flags().String("inactive-days", strconv.Itoa(defaultInactiveDays), "Days without launches that make a user inactive")
+	cmd.Flags().String("until", "", "End of the report (default now)")
+	cmd.Flags().StringP("format", "f", "csv", "Output format: csv or json")
+	cmd.RunE = caddycmd.WrapCommandFuncForCobra(cmdReport)
+	return cmd
+}
+
+func cmdReport(fl caddycmd.Flags) (int, error) {
+	format := fl.String("format")
+	if format != "csv" && format != "json" {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("unknown format %q: must be csv or json", format)
+	}
+	path := fl.String("store")
+	if path == "" {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("a --store file must be specified")
+	}
+	params, err := parseReportParams(fl.String("until"), fl.String("window"), fl.String("inactive-days"), time.Now())
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	sessions, err := readSessionStore(path)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if err := buildUsageReport(sessions, params).write(os.Stdout, format); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+// handleReport serves a usage report built from the session stores
+// of all the running trackers. The query parameters window,
+// inactive_days, until, and format work like the CLI flags.
+func (trackerAdmin) handleReport(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+	}
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "csv" && format != "json" {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("unknown format %q: must be csv or json", format)}
+	}
+	params, err := parseReportParams(query.Get("until"), query.Get("window"), query.Get("inactive_days"), time.Now())
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+	}
+	stores := make(map[*sessionStore]bool)
+	for _, m := range registeredTrackers() {
+		if m.store != nil {
+			stores[m.store] = true
+		}
+	}
+	if len(stores) == 0 {
+		return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("no tracker has a session_store")}
+	}
+	merged := make(map[string]logSession)
+	for store := range stores {
+		sessions, err := store.sessions()
+		if err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+		}
+		for _, session := range sessions {
+			if prior, ok := merged[session.sessionId]; ok {
+				session = mergeSession(prior, session)
+			}
+			merged[session.sessionId] = session
+		}
+	}
+	sessions := make([]logSession, 0, len(merged))
+	for _, session := range merged {
+		sessions = append(sessions, session)
+	}
+	if format == "csv" {
+		w.Header().Set("Content-Type", reportContentTypeCSV)
+	} else {
+		w.Header().Set("Content-Type", reportContentTypeJSON)
+	}
+	if err := buildUsageReport(sessions, params).write(w, format); err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/caddyserver/caddy/v2"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var reportEnd = time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+// reportSession returns a session for the given user and app that
+// was launched the given number of days before the end of the report.
+func reportSession(id, user, app string, daysAgo int, duration time.Duration) logSession {
+	return logSession{
+		sessionId:      id,
+		launchTime:     reportEnd.AddDate(0, 0, -daysAgo),
+		launchDuration: duration,
+		appId:          app,
+		userId:         user,
+	}
+}
+
+var reportSessions = []logSession{
+	reportSession("s1", "alice", "Photoshop1", 2, time.Hour),
+	reportSession("s2", "alice", "Photoshop1", 10, 2*time.Hour),
+	reportSession("s3", "alice", "Illustrator1", 40, time.Hour),
+	reportSession("s4", "bob", "InDesign1", 45, 3*time.Hour),
+	reportSession("s5", "", "AcrobatDC1", 1, time.Minute),
+	reportSession("s6", "carol", "AcrobatDC1", -1, time.Minute),
+}
+
+func TestBuildUsageReport(t *testing.T) {
+	params, err := parseReportParams("2024-06-01", "30d", "30", time.Now())
+	if err != nil {
+		t.Fatalf("parseReportParams failed: %v", err)
+	}
+	report := buildUsageReport(reportSessions, params)
+	if len(report.Users) != 2 {
+		t.Fatalf("Expected 2 users, got %+v", report.Users)
+	}
+	bob, alice := report.Users[0], report.Users[1]
+	if bob.UserId != "bob" || !bob.Inactive || len(bob.Apps) != 0 || !bob.LastLaunch.Equal(reportEnd.AddDate(0, 0, -45)) {
+		t.Errorf("Unexpected report for bob: %+v", bob)
+	}
+	if alice.UserId != "alice" || alice.Inactive || len(alice.Apps) != 1 {
+		t.Fatalf("Unexpected report for alice: %+v", alice)
+	}
+	if app := alice.Apps[0]; app.AppId != "Photoshop1" || app.Launches != 2 || app.TotalDuration != (3*time.Hour).Milliseconds() {
+		t.Errorf("Unexpected app usage for alice: %+v", app)
+	}
+	var buf bytes.Buffer
+	if err := report.write(&buf, "csv"); err != nil {
+		t.Fatalf("CSV output failed: %v", err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil || len(rows) != 3 {
+		t.Fatalf("Expected header and 2 rows, got %v (%v)", rows, err)
+	}
+	if rows[1][0] != "bob" || rows[1][2] != "true" || rows[2][3] != "Photoshop1" || rows[2][5] != "2" {
+		t.Errorf("Unexpected CSV rows: %v", rows)
+	}
+}
+
+func TestParseReportParams(t *testing.T) {
+	now := time.Now()
+	if params, err := parseReportParams("", "", "", now); err != nil ||
+		!params.until.Equal(now) || params.window != 30*24*time.Hour || params.inactiveDays != 30 {
+		t.Errorf("Unexpected defaults: %+v (%v)", params, err)
+	}
+	for _, bad := range [][3]string{{"soon", "", ""}, {"", "-1d", ""}, {"", "", "0"}, {"", "", "many"}} {
+		if _, err := parseReportParams(bad[0], bad[1], bad[2], now); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+}
+
+func TestAdminReport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.jsonl")
+	m := &AdobeUsageTracker{DryRun: true, Position: "first", SessionStore: path}
+	if err := m.Provision(caddy.Context{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	defer func() { _ = m.Cleanup() }()
+	if err := m.store.add(reportSessions); err != nil {
+		t.Fatal(err)
+	}
+	var admin trackerAdmin
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/adobe-usage-tracker/report?until=2024-06-01&inactive_days=7", nil)
+	if err := admin.handleReport(rec, req); err != nil {
+		t.Fatalf("handleReport failed: %v", err)
+	}
+	var report usageReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Invalid report JSON: %v\n%s", err, rec.Body.String())
+	}
+	if len(report.Users) != 2 || report.InactiveDays != 7 || !report.Users[0].Inactive || report.Users[1].Inactive {
+		t.Errorf("Unexpected report: %s", rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/adobe-usage-tracker/report?format=csv", nil)
+	if err := admin.handleReport(rec, req); err != nil {
+		t.Fatalf("handleReport failed: %v", err)
+	}
+	if rec.Header().Get("Content-Type") != reportContentTypeCSV {
+		t.Errorf("Expected CSV content type, got %q", rec.Header().Get("Content-Type"))
+	}
+	req = httptest.NewRequest(http.MethodGet, "/adobe-usage-tracker/report?format=xml", nil)
+	if err := admin.handleReport(httptest.NewRecorder(), req); err == nil {
+		t.Errorf("Expected an error for an unknown format")
+	}
+}
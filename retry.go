@@ -0,0 +1,231 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A retryPolicy controls how failed uploads are retried. Retries
+// use jittered exponential backoff, starting at initialInterval
+// and capped at maxInterval, and they stop once maxElapsed time
+// has passed since the first attempt. A server-supplied
+// Retry-After value always takes precedence over the backoff.
+// A policy with a zero (or negative) maxElapsed never retries.
+type retryPolicy struct {
+	initialInterval time.Duration
+	maxInterval     time.Duration
+	maxElapsed      time.Duration
+}
+
+var defaultRetryPolicy = retryPolicy{
+	initialInterval: 500 * time.Millisecond,
+	maxInterval:     30 * time.Second,
+	maxElapsed:      2 * time.Minute,
+}
+
+// newRetryPolicy returns the default policy with the given
+// maximum elapsed time. A zero value means use the default,
+// and a negative value means never retry.
+func newRetryPolicy(maxElapsed time.Duration) retryPolicy {
+	p := defaultRetryPolicy
+	if maxElapsed != 0 {
+		p.maxElapsed = maxElapsed
+	}
+	return p
+}
+
+// run calls attempt until it succeeds, until it fails with an
+// error that isn't retryable, or until the next retry would
+// start after the policy's elapsed time has run out.
+func (p retryPolicy) run(attempt func() error, logger *zap.Logger) error {
+	start := time.Now()
+	interval := p.initialInterval
+	for count := 1; ; count++ {
+		err := attempt()
+		if err == nil {
+			return nil
+		}
+		var ue *uploadError
+		if !errors.As(err, &ue) || !ue.retryable {
+			return err
+		}
+		wait := jitter(interval)
+		if ue.retryAfter > 0 {
+			wait = ue.retryAfter
+		}
+		if time.Since(start)+wait > p.maxElapsed {
+			if count > 1 {
+				logger.Error("AdobeUsageTracker: giving up on upload",
+					zap.Int("attempts", count),
+					zap.Duration("elapsed", time.Since(start)))
+			}
+			return err
+		}
+		logger.Warn("AdobeUsageTracker: will retry upload",
+			zap.Int("attempt", count),
+			zap.Duration("wait", wait),
+			zap.Error(err))
+		time.Sleep(wait)
+		interval = min(2*interval, p.maxInterval)
+	}
+}
+
+// jitter returns a random duration between half and all of d.
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	return d/2 + rand.N(d/2)
+}
+
+// An uploadError describes a failed upload attempt. The
+// retryable flag says whether trying again might succeed.
+type uploadError struct {
+	status     int           // HTTP status, or 0 if there was no response
+	message    string        // error message from the server, if any
+	retryable  bool          // whether a retry might succeed
+	retryAfter time.Duration // server-requested retry delay, if any
+	badLines   []int         // 1-based numbers of lines rejected by a partial write
+	err        error         // the underlying request error, if any
+}
+
+func (e *uploadError) Error() string {
+	if e.status == 0 {
+		return fmt.Sprintf("upload request error: %v", e.err)
+	}
+	msg := fmt.Sprintf("upload status code: %d", e.status)
+	if len(e.badLines) > 0 {
+		nums := make([]string, 0, len(e.badLines))
+		for _, n := range e.badLines {
+			nums = append(nums, strconv.Itoa(n))
+		}
+		msg += fmt.Sprintf(" (rejected lines: %s)", strings.Join(nums, ", "))
+	}
+	if e.message != "" {
+		msg += ": " + e.message
+	}
+	return msg
+}
+
+func (e *uploadError) Unwrap() error {
+	return e.err
+}
+
+// requestError classifies an error returned by the HTTP client.
+// Timeouts and network-level failures are retryable, but other
+// failures (such as a bad URL or a certificate problem) are not.
+func requestError(err error) *uploadError {
+	var netErr net.Error
+	var opErr *net.OpError
+	var certErr *tls.CertificateVerificationError
+	retryable := errors.As(err, &opErr) || (errors.As(err, &netErr) && netErr.Timeout())
+	if errors.As(err, &certErr) {
+		retryable = false
+	}
+	return &uploadError{err: err, retryable: retryable}
+}
+
+var (
+	partialLineRegex  = regexp.MustCompile(`line (\d+)`)
+	partialParseRegex = regexp.MustCompile(`unable to parse '([^']*)'`)
+)
+
+// responseError classifies a non-success response from Influx.
+// Rate limiting (429) and server errors (5xx) are retryable, and
+// any Retry-After header is honored. Other statuses, such as
+// 400 (partial write), 401 (bad token), and 404 (no such
+// database), are permanent. For partial writes, the server's
+// message is searched for the numbers of the rejected lines.
+func responseError(status int, header http.Header, body []byte, lines []string) *uploadError {
+	e := &uploadError{status: status, message: influxErrorMessage(body)}
+	switch {
+	case status == http.StatusTooManyRequests || status == http.StatusRequestTimeout:
+		e.retryable = true
+	case status >= 500 && status != http.StatusNotImplemented:
+		e.retryable = true
+	}
+	if e.retryable {
+		e.retryAfter = parseRetryAfter(header.Get("Retry-After"), time.Now())
+	}
+	if status == http.StatusBadRequest {
+		e.badLines = partialWriteLines(e.message, lines)
+	}
+	return e
+}
+
+// influxErrorMessage extracts the error message from the body of
+// an Influx error response. The v1 API returns {"error": "..."}
+// and the v2/v3 APIs return {"code": "...", "message": "..."}.
+func influxErrorMessage(body []byte) string {
+	var parsed struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &parsed); err == nil {
+		if parsed.Message != "" {
+			return parsed.Message
+		}
+		if parsed.Error != "" {
+			return parsed.Error
+		}
+	}
+	return strings.TrimSpace(string(body))
+}
+
+// partialWriteLines finds the numbers of rejected lines in a
+// partial-write message. Some servers report line numbers directly,
+// others quote the text of the line they couldn't parse.
+func partialWriteLines(message string, lines []string) []int {
+	var nums []int
+	for _, match := range partialLineRegex.FindAllStringSubmatch(message, -1) {
+		if n, err := strconv.Atoi(match[1]); err == nil && !slices.Contains(nums, n) {
+			nums = append(nums, n)
+		}
+	}
+	for _, match := range partialParseRegex.FindAllStringSubmatch(message, -1) {
+		for i, line := range lines {
+			if line == match[1] && !slices.Contains(nums, i+1) {
+				nums = append(nums, i+1)
+			}
+		}
+	}
+	slices.Sort(nums)
+	return nums
+}
+
+// parseRetryAfter interprets the value of a Retry-After header,
+// which is either a number of seconds or an HTTP date. It returns
+// zero if the value is missing or malformed.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
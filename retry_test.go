@@ -0,0 +1,167 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"errors"
+	"go.uber.org/zap/zaptest"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testRetryPolicy = retryPolicy{
+	initialInterval: time.Millisecond,
+	maxInterval:     5 * time.Millisecond,
+	maxElapsed:      3 * time.Second,
+}
+
+// statusServer returns a test server that responds to successive
+// requests with the given statuses, repeating the last one, and
+// a pointer to the count of requests it has received.
+func statusServer(t *testing.T, header http.Header, body string, statuses ...int) (*httptest.Server, *atomic.Int32) {
+	var count atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(count.Add(1))
+		status := statuses[min(n, len(statuses))-1]
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(status)
+		if status != http.StatusNoContent {
+			_, _ = w.Write([]byte(body))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &count
+}
+
+func TestRetryTransientFailures(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	server, count := statusServer(t, nil, `{"error":"busy"}`, 503, 500, 429, 204)
+	sink := newInfluxSink(server.URL, "db", "rp", staticToken("tok"), testRetryPolicy)
+	if err := sink.uploadLines([]string{"m,t=1 f=1i 1"}, logger); err != nil {
+		t.Fatalf("uploadLines failed: %v", err)
+	}
+	if n := count.Load(); n != 4 {
+		t.Errorf("Expected 4 attempts, got %d", n)
+	}
+}
+
+func TestRetryHonorsRetryAfter(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	header := http.Header{"Retry-After": []string{"1"}}
+	server, count := statusServer(t, header, `{"error":"slow down"}`, 429, 204)
+	sink := newInfluxSink(server.URL, "db", "rp", staticToken("tok"), testRetryPolicy)
+	start := time.Now()
+	if err := sink.uploadLines([]string{"m,t=1 f=1i 1"}, logger); err != nil {
+		t.Fatalf("uploadLines failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("Expected retry after at least 1s, got %v", elapsed)
+	}
+	if n := count.Load(); n != 2 {
+		t.Errorf("Expected 2 attempts, got %d", n)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	server, count := statusServer(t, nil, "", 503)
+	policy := testRetryPolicy
+	policy.maxElapsed = 20 * time.Millisecond
+	sink := newInfluxSink(server.URL, "db", "rp", staticToken("tok"), policy)
+	err := sink.uploadLines([]string{"m,t=1 f=1i 1"}, logger)
+	var ue *uploadError
+	if !errors.As(err, &ue) || ue.status != 503 {
+		t.Fatalf("Expected 503 upload error, got %v", err)
+	}
+	if n := count.Load(); n < 2 {
+		t.Errorf("Expected multiple attempts, got %d", n)
+	}
+}
+
+func TestNoRetryPermanentFailures(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	for _, status := range []int{400, 401, 404} {
+		server, count := statusServer(t, nil, `{"error":"nope"}`, status, 204)
+		sink := newInfluxSink(server.URL, "db", "rp", staticToken("tok"), testRetryPolicy)
+		err := sink.uploadLines([]string{"m,t=1 f=1i 1"}, logger)
+		var ue *uploadError
+		if !errors.As(err, &ue) || ue.status != status || ue.retryable {
+			t.Errorf("Expected permanent %d upload error, got %v", status, err)
+		}
+		if n := count.Load(); n != 1 {
+			t.Errorf("%d: Expected 1 attempt, got %d", status, n)
+		}
+	}
+}
+
+func TestNoRetryWhenDisabled(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	server, count := statusServer(t, nil, "", 503, 204)
+	sink := newInfluxSink(server.URL, "db", "rp", staticToken("tok"), newRetryPolicy(-1))
+	if err := sink.uploadLines([]string{"m,t=1 f=1i 1"}, logger); err == nil {
+		t.Errorf("Expected an error with retries disabled")
+	}
+	if n := count.Load(); n != 1 {
+		t.Errorf("Expected 1 attempt, got %d", n)
+	}
+}
+
+func TestRetryNetworkError(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	server, _ := statusServer(t, nil, "", 204)
+	server.Close()
+	policy := testRetryPolicy
+	policy.maxElapsed = 20 * time.Millisecond
+	sink := newInfluxSink(server.URL, "db", "rp", staticToken("tok"), policy)
+	err := sink.uploadLines([]string{"m,t=1 f=1i 1"}, logger)
+	var ue *uploadError
+	if !errors.As(err, &ue) || ue.status != 0 || !ue.retryable {
+		t.Errorf("Expected retryable network error, got %v", err)
+	}
+}
+
+func TestPartialWriteLines(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	lines := []string{"good 1", "bad line", "good 2", "worse line"}
+	v1 := `{"error":"partial write: unable to parse 'bad line': missing fields; unable to parse 'worse line': missing fields dropped=0"}`
+	v2 := `{"code":"invalid","message":"partial write has occurred, errors encountered on line(s): line 2: missing fields; line 4: missing fields"}`
+	for _, body := range []string{v1, v2} {
+		server, _ := statusServer(t, nil, body, 400)
+		sink := newInfluxSink(server.URL, "db", "rp", staticToken("tok"), testRetryPolicy)
+		err := sink.uploadLines(lines, logger)
+		var ue *uploadError
+		if !errors.As(err, &ue) {
+			t.Fatalf("Expected upload error, got %v", err)
+		}
+		if !slices.Equal(ue.badLines, []int{2, 4}) {
+			t.Errorf("Expected bad lines [2 4], got %v (from %s)", ue.badLines, body)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	cases := map[string]time.Duration{
+		"":                              0,
+		"7":                             7 * time.Second,
+		"-3":                            0,
+		"soon":                          0,
+		"Sat, 01 Jun 2024 12:00:30 GMT": 30 * time.Second,
+		"Sat, 01 Jun 2024 11:00:00 GMT": 0,
+	}
+	for value, expected := range cases {
+		if got := parseRetryAfter(value, now); got != expected {
+			t.Errorf("parseRetryAfter(%q): expected %v, got %v", value, expected, got)
+		}
+	}
+}
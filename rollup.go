@@ -0,0 +1,362 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// rollupLateDays is how many days after a day closes that
+	// late-arriving sessions still update its rollup.
+	rollupLateDays = 2
+	// rollupCheckEvery is how often the rollup checks for day close.
+	rollupCheckEvery = time.Minute
+)
+
+// A rollupKey identifies a group of sessions in a daily rollup.
+type rollupKey struct {
+	appId      string
+	appVersion string
+	osName     string
+	site       string
+}
+
+// A rollupDay holds the sessions launched on a day, and the
+// keys for which rollup points have been uploaded (so that a
+// key whose sessions have all moved to another key, because a
+// late fragment filled in a missing app, can be zeroed out).
+type rollupDay struct {
+	sessions map[string]logSession
+	emitted  map[rollupKey]bool
+	closed   bool
+}
+
+// A dailyRollup aggregates sessions by day (in loc) and by
+// rollupKey, and uploads a log-session-daily measurement for
+// each day when the day closes. Sessions for a closed day that
+// arrive within rollupLateDays of its close cause that day's
+// rollup to be recomputed and uploaded again, replacing the
+// earlier points (since they have the same tags and timestamp).
+//
+// A dailyRollup is shared by all the trackers with the same
+// configuration, so its state survives a config reload. Its state
+// is only kept in memory, but when the tracker has a session store
+// a new rollup rebuilds it from there, so that a restart doesn't
+// lose the days that are still open or can still be updated.
+type dailyRollup struct {
+	loc   *time.Location
+	sites siteTable
+
+	mu   sync.Mutex
+	sink lineSink
+	days map[time.Time]*rollupDay
+	stop chan struct{}
+}
+
+var dailyRollups = caddy.NewUsagePool()
+
+// loadDailyRollup returns the shared rollup for the given key,
+// creating (and starting) it if necessary, and directs its uploads
+// to sink. A new rollup is restored from store, if it isn't nil.
+// Each call must be matched by a call to releaseDailyRollup.
+func loadDailyRollup(key string, loc *time.Location, sites siteTable, sink lineSink, store *sessionStore) (*dailyRollup, error) {
+	value, _, err := dailyRollups.LoadOrNew(key, func() (caddy.Destructor, error) {
+		r := newDailyRollup(loc, sites)
+		if store != nil {
+			if err := r.restore(store, time.Now(), caddy.Log()); err != nil {
+				return nil, fmt.Errorf("cannot restore daily rollup from session store: %v", err)
+			}
+		}
+		go r.run(caddy.Log())
+		return r, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	r := value.(*dailyRollup)
+	r.mu.Lock()
+	r.sink = sink
+	r.mu.Unlock()
+	return r, nil
+}
+
+func releaseDailyRollup(key string) error {
+	_, err := dailyRollups.Delete(key)
+	return err
+}
+
+func newDailyRollup(loc *time.Location, sites siteTable) *dailyRollup {
+	return &dailyRollup{
+		loc:   loc,
+		sites: sites,
+		days:  make(map[time.Time]*rollupDay),
+		stop:  make(chan struct{}),
+	}
+}
+
+// Destruct implements caddy.Destructor.
+func (r *dailyRollup) Destruct() error {
+	close(r.stop)
+	return nil
+}
+
+// run closes days as they end, until the rollup is destructed.
+func (r *dailyRollup) run(logger *zap.Logger) {
+	ticker := time.NewTicker(rollupCheckEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case now := <-ticker.C:
+			r.tick(now, logger)
+		}
+	}
+}
+
+// add records the given sessions. Sessions for a day that has
+// already closed cause that day's rollup to be uploaded again.
+func (r *dailyRollup) add(sessions []logSession, now time.Time, logger *zap.Logger) {
+	r.send(r.update(sessions, now, logger), logger)
+}
+
+// update records the given sessions, and returns the lines to be
+// uploaded (by send) for the days that had already closed.
+func (r *dailyRollup) update(sessions []logSession, now time.Time, logger *zap.Logger) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.linesFor(r.record(sessions, now, logger))
+}
+
+// send uploads lines returned by update.
+func (r *dailyRollup) send(lines []string, logger *zap.Logger) {
+	r.mu.Lock()
+	sink := r.sink
+	r.mu.Unlock()
+	r.upload(sink, lines, logger)
+}
+
+// restore records the sessions in the store that are recent enough
+// to be in the rollup. None of their days are closed, so the next
+// tick uploads the days that have ended, including any that were
+// already uploaded before a restart (which replaces those points
+// with the same values).
+func (r *dailyRollup) restore(store *sessionStore, now time.Time, logger *zap.Logger) error {
+	sessions, err := store.sessions()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record(sessions, now, logger)
+	return nil
+}
+
+// record adds the given sessions to their days, and returns the
+// closed days that they changed. It must be called with the lock held.
+func (r *dailyRollup) record(sessions []logSession, now time.Time, logger *zap.Logger) []time.Time {
+	oldest := startOfDay(now, r.loc).AddDate(0, 0, -rollupLateDays)
+	var dirty []time.Time
+	for _, s := range sessions {
+		day := startOfDay(s.launchTime, r.loc)
+		if day.Before(oldest) {
+			logger.Debug("AdobeUsageTracker: session too old for daily rollup", zap.Object("session", s))
+			continue
+		}
+		d := r.days[day]
+		if d == nil {
+			d = &rollupDay{sessions: make(map[string]logSession), emitted: make(map[rollupKey]bool)}
+			r.days[day] = d
+		}
+		if prior, ok := d.sessions[s.sessionId]; ok {
+			s = mergeSession(prior, s)
+		}
+		d.sessions[s.sessionId] = s
+		if d.closed && !slices.ContainsFunc(dirty, day.Equal) {
+			dirty = append(dirty, day)
+		}
+	}
+	return dirty
+}
+
+// tick closes (and uploads) every day that has ended by now,
+// and forgets days too old to be updated by late sessions.
+func (r *dailyRollup) tick(now time.Time, logger *zap.Logger) {
+	r.mu.Lock()
+	today := startOfDay(now, r.loc)
+	var closing []time.Time
+	for day, d := range r.days {
+		if day.Before(today.AddDate(0, 0, -rollupLateDays)) {
+			delete(r.days, day)
+		} else if !d.closed && day.Before(today) {
+			d.closed = true
+			closing = append(closing, day)
+		}
+	}
+	slices.SortFunc(closing, func(a, b time.Time) int { return a.Compare(b) })
+	lines := r.linesFor(closing)
+	sink := r.sink
+	r.mu.Unlock()
+	r.upload(sink, lines, logger)
+}
+
+func (r *dailyRollup) upload(sink lineSink, lines []string, logger *zap.Logger) {
+	if len(lines) == 0 || sink == nil {
+		return
+	}
+	if err := sink.uploadLines(lines, logger); err != nil {
+		logger.Error("AdobeUsageTracker: failed to send daily rollup", zap.Error(err))
+	}
+}
+
+// linesFor computes the rollup lines for the given days, including
+// zeroed lines for keys that were uploaded before but have no
+// sessions now. It must be called with the lock held.
+func (r *dailyRollup) linesFor(days []time.Time) []string {
+	var lines []string
+	for _, day := range days {
+		d := r.days[day]
+		groups := make(map[rollupKey][]logSession)
+		for _, s := range d.sessions {
+			key := rollupKey{s.appId, s.appVersion, s.osName, r.sites.lookup(s.clientIp)}
+			groups[key] = append(groups[key], s)
+		}
+		for key := range d.emitted {
+			if _, ok := groups[key]; !ok {
+				groups[key] = nil
+			}
+		}
+		keys := make([]rollupKey, 0, len(groups))
+		for key := range groups {
+			keys = append(keys, key)
+			d.emitted[key] = true
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+		})
+		for _, key := range keys {
+			lines = append(lines, rollupLine(key, day, groups[key]))
+		}
+	}
+	return lines
+}
+
+// rollupLine constructs a line protocol line summarizing the
+// given sessions: their count, the number of distinct users and
+// clients, and the 50th, 90th, and 99th percentile durations.
+func rollupLine(key rollupKey, day time.Time, sessions []logSession) string {
+	users := make(map[string]bool)
+	clients := make(map[string]bool)
+	durations := make([]int64, 0, len(sessions))
+	for _, s := range sessions {
+		if s.userId != "" {
+			users[s.userId] = true
+		}
+		if s.clientIp != "" {
+			clients[s.clientIp] = true
+		}
+		durations = append(durations, s.launchDuration.Milliseconds())
+	}
+	slices.Sort(durations)
+	tags := ""
+	for _, tag := range [][2]string{
+		{"appId", key.appId},
+		{"appVersion", key.appVersion},
+		{"osName", key.osName},
+		{"site", key.site},
+	} {
+		if tag[1] != "" {
+			tags += "," + tag[0] + "=" + escapeTag(tag[1])
+		}
+	}
+	return fmt.Sprintf("log-session-daily%s count=%di,users=%di,clients=%di,durationP50=%di,durationP90=%di,durationP99=%di %d",
+		tags,
+		len(sessions),
+		len(users),
+		len(clients),
+		percentile(durations, 50),
+		percentile(durations, 90),
+		percentile(durations, 99),
+		day.UnixMilli(),
+	)
+}
+
+// percentile returns the p-th percentile of the sorted values,
+// using the nearest-rank method, or zero if there are no values.
+func percentile(sorted []int64, p int) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	return sorted[max(rank, 1)-1]
+}
+
+// escapeTag escapes a line protocol tag key or value.
+func escapeTag(s string) string {
+	return strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `).Replace(s)
+}
+
+// A siteTable maps client IPs to named sites by address prefix.
+type siteTable []siteRange
+
+type siteRange struct {
+	name   string
+	prefix netip.Prefix
+}
+
+// newSiteTable builds a site table from a map of site names to
+// address prefixes (in CIDR notation) or single addresses.
+func newSiteTable(sites map[string][]string) (siteTable, error) {
+	var table siteTable
+	for name, cidrs := range sites {
+		for _, cidr := range cidrs {
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				addr, addrErr := netip.ParseAddr(cidr)
+				if addrErr != nil {
+					return nil, fmt.Errorf("site %s: invalid address range %q: %v", name, cidr, err)
+				}
+				prefix = netip.PrefixFrom(addr, addr.BitLen())
+			}
+			table = append(table, siteRange{name: name, prefix: prefix.Masked()})
+		}
+	}
+	// check the most specific prefixes first
+	sort.Slice(table, func(i, j int) bool {
+		if table[i].prefix.Bits() != table[j].prefix.Bits() {
+			return table[i].prefix.Bits() > table[j].prefix.Bits()
+		}
+		return table[i].name < table[j].name
+	})
+	return table, nil
+}
+
+// lookup returns the site containing the given client IP,
+// or the empty string if there is no such site.
+func (t siteTable) lookup(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap()
+	for _, site := range t {
+		if site.prefix.Contains(addr) {
+			return site.name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,174 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"go.uber.org/zap/zaptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDailyRollupClosesDays(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	sites, err := newSiteTable(map[string][]string{"main office": {"10.0.0.0/8"}, "lab": {"10.1.0.0/16", "192.168.1.7"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &recordingSink{}
+	r := newDailyRollup(time.UTC, sites)
+	r.sink = sink
+	day := time.Date(2024, 5, 30, 0, 0, 0, 0, time.UTC)
+	session := func(id, user, ip string, hour int, minutes int) logSession {
+		return logSession{
+			sessionId:      id,
+			launchTime:     day.Add(time.Duration(hour) * time.Hour),
+			launchDuration: time.Duration(minutes) * time.Minute,
+			clientIp:       ip,
+			appId:          "Photoshop1",
+			appVersion:     "25.9.0",
+			osName:         "MAC",
+			userId:         user,
+		}
+	}
+	r.add([]logSession{
+		session("s1", "alice", "10.0.0.1", 9, 10),
+		session("s2", "alice", "10.0.0.2", 10, 20),
+		session("s3", "bob", "10.0.0.2", 11, 30),
+		session("s4", "carol", "10.1.2.3", 12, 40),
+	}, day.Add(13*time.Hour), logger)
+	r.tick(day.Add(23*time.Hour), logger)
+	if len(sink.lines) != 0 {
+		t.Fatalf("Expected no upload before day close, got %v", sink.lines)
+	}
+	r.tick(day.Add(24*time.Hour+time.Minute), logger)
+	expected := []string{
+		"log-session-daily,appId=Photoshop1,appVersion=25.9.0,osName=MAC,site=lab count=1i,users=1i,clients=1i,durationP50=2400000i,durationP90=2400000i,durationP99=2400000i 1717027200000",
+		`log-session-daily,appId=Photoshop1,appVersion=25.9.0,osName=MAC,site=main\ office count=3i,users=2i,clients=2i,durationP50=1200000i,durationP90=1800000i,durationP99=1800000i 1717027200000`,
+	}
+	if strings.Join(sink.lines, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Unexpected rollup lines:\n%s", strings.Join(sink.lines, "\n"))
+	}
+	// a later fragment of a session updates the closed day
+	sink.lines = nil
+	r.add([]logSession{session("s1", "alice", "10.0.0.1", 9, 50)}, day.Add(25*time.Hour), logger)
+	if len(sink.lines) != 2 || !strings.Contains(sink.lines[1], "count=3i,users=2i,clients=2i,durationP50=1800000i,durationP90=3000000i") {
+		t.Errorf("Unexpected late rollup lines:\n%s", strings.Join(sink.lines, "\n"))
+	}
+	// a fragment that moves a session to another group zeroes the old one
+	sink.lines = nil
+	moved := session("s4", "carol", "10.1.2.3", 12, 45)
+	moved.appVersion = "25.9.1"
+	r.add([]logSession{moved}, day.Add(25*time.Hour), logger)
+	if len(sink.lines) != 3 || !strings.Contains(sink.lines[0], "appVersion=25.9.0,osName=MAC,site=lab count=0i,users=0i") {
+		t.Errorf("Expected zeroed old group, got:\n%s", strings.Join(sink.lines, "\n"))
+	}
+	// sessions too old to update are ignored, and old days are forgotten
+	sink.lines = nil
+	r.tick(day.AddDate(0, 0, 4), logger)
+	r.add([]logSession{session("s5", "dave", "10.0.0.5", 9, 10)}, day.AddDate(0, 0, 4), logger)
+	if len(sink.lines) != 0 || len(r.days) != 0 {
+		t.Errorf("Expected old day to be forgotten, got %d days and lines %v", len(r.days), sink.lines)
+	}
+}
+
+func TestDailyRollupRestoresFromStore(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	day := time.Date(2024, 5, 30, 0, 0, 0, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), "sessions.jsonl")
+	sessions := []logSession{
+		{sessionId: "s1", launchTime: day.Add(9 * time.Hour), launchDuration: time.Minute, appId: "Photoshop1"},
+		{sessionId: "s2", launchTime: day.Add(10 * time.Hour), launchDuration: time.Minute, appId: "Photoshop1"},
+		{sessionId: "s3", launchTime: day.AddDate(0, 0, -5), launchDuration: time.Minute, appId: "Photoshop1"},
+	}
+	if err := writeSessionStore(path, sessions); err != nil {
+		t.Fatal(err)
+	}
+	store, err := loadSessionStore(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = releaseSessionStore(path) }()
+	// a restart just after midnight still uploads the day that ended
+	sink := &recordingSink{}
+	r := newDailyRollup(time.UTC, nil)
+	r.sink = sink
+	now := day.Add(24*time.Hour + time.Minute)
+	if err := r.restore(store, now, logger); err != nil {
+		t.Fatal(err)
+	}
+	r.tick(now, logger)
+	if len(sink.lines) != 1 || !strings.HasPrefix(sink.lines[0], "log-session-daily,appId=Photoshop1 count=2i,") {
+		t.Errorf("Unexpected restored rollup lines:\n%s", strings.Join(sink.lines, "\n"))
+	}
+	// a late fragment after the restart updates the full day
+	sink.lines = nil
+	r.add([]logSession{{sessionId: "s2", launchTime: day.Add(10 * time.Hour), launchDuration: time.Hour, appId: "Photoshop1"}}, now, logger)
+	if len(sink.lines) != 1 || !strings.Contains(sink.lines[0], "count=2i,") {
+		t.Errorf("Unexpected late rollup lines:\n%s", strings.Join(sink.lines, "\n"))
+	}
+}
+
+func TestDailyRollupUpdateDoesNoUploads(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	sink := &recordingSink{}
+	r := newDailyRollup(time.UTC, nil)
+	r.sink = sink
+	day := time.Date(2024, 5, 30, 0, 0, 0, 0, time.UTC)
+	s := logSession{sessionId: "s1", launchTime: day.Add(9 * time.Hour), launchDuration: time.Minute, appId: "Photoshop1"}
+	// an open day's sessions are only recorded
+	if lines := r.update([]logSession{s}, day.Add(10*time.Hour), logger); len(lines) != 0 || len(r.days[day].sessions) != 1 {
+		t.Errorf("Expected the session to be recorded with nothing to upload, got %v", lines)
+	}
+	// a closed day's update returns its lines, which send uploads
+	r.tick(day.Add(25*time.Hour), logger)
+	sink.lines = nil
+	s.launchDuration = time.Hour
+	lines := r.update([]logSession{s}, day.Add(25*time.Hour), logger)
+	if len(lines) != 1 || len(sink.lines) != 0 {
+		t.Fatalf("Expected one line to upload and none uploaded, got %v and %v", lines, sink.lines)
+	}
+	r.send(lines, logger)
+	if len(sink.lines) != 1 || !strings.Contains(sink.lines[0], "durationP50=3600000i") {
+		t.Errorf("Unexpected uploaded lines: %v", sink.lines)
+	}
+}
+
+func TestSiteTable(t *testing.T) {
+	sites, err := newSiteTable(map[string][]string{"hq": {"10.0.0.0/8", "2001:db8::/32"}, "lab": {"10.1.0.0/16"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, site := range map[string]string{
+		"10.2.3.4":        "hq",
+		"10.1.3.4":        "lab",
+		"::ffff:10.1.3.4": "lab",
+		"2001:db8::1":     "hq",
+		"192.168.1.1":     "",
+		"not-an-ip":       "",
+	} {
+		if got := sites.lookup(ip); got != site {
+			t.Errorf("%s: expected site %q, got %q", ip, site, got)
+		}
+	}
+	if _, err := newSiteTable(map[string][]string{"bad": {"10.0.0.0/33"}}); err == nil {
+		t.Errorf("Expected an error for an invalid range")
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	values := []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	for p, expected := range map[int]int64{50: 5, 90: 9, 99: 10, 100: 10, 1: 1} {
+		if got := percentile(values, p); got != expected {
+			t.Errorf("p%d: expected %d, got %d", p, expected, got)
+		}
+	}
+	if percentile(nil, 50) != 0 {
+		t.Errorf("Expected zero percentile of no values")
+	}
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A tokenSource supplies the API token used for uploads.
+type tokenSource interface {
+	token() (string, error)
+}
+
+// A staticToken is a token given directly in the configuration.
+type staticToken string
+
+func (t staticToken) token() (string, error) {
+	return string(t), nil
+}
+
+// A fileToken is a token read from a file, such as a mounted
+// Kubernetes secret. The file is checked before each use, and
+// is re-read whenever its modification time or size changes,
+// so that rotated tokens are picked up without a reload. If
+// the file can't be read after a successful read, the last
+// good token is used until it can be.
+type fileToken struct {
+	path string
+
+	mu      sync.Mutex
+	value   string
+	modTime time.Time
+	size    int64
+}
+
+func newFileToken(path string) *fileToken {
+	return &fileToken{path: path}
+}
+
+func (f *fileToken) token() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return f.fallback(err)
+	}
+	if f.value != "" && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.value, nil
+	}
+	content, err := os.ReadFile(f.path)
+	if err != nil {
+		return f.fallback(err)
+	}
+	value := strings.TrimSpace(string(content))
+	if value == "" {
+		return f.fallback(fmt.Errorf("token file %q is empty", f.path))
+	}
+	f.value, f.modTime, f.size = value, info.ModTime(), info.Size()
+	return f.value, nil
+}
+
+func (f *fileToken) fallback(err error) (string, error) {
+	if f.value != "" {
+		caddy.Log().Warn("AdobeUsageTracker: can't re-read token file, using previous token",
+			zap.String("path", f.path), zap.Error(err))
+		return f.value, nil
+	}
+	return "", fmt.Errorf("can't read token file: %w", err)
+}
+
+// resolvePlaceholders replaces any global Caddy placeholders,
+// such as {env.INFLUX_TOKEN} or {file./run/secrets/token}, in
+// the given configuration value. It's an error for the value to
+// contain unknown placeholders or ones that resolve to nothing.
+// Because file placeholders pick up trailing newlines, the
+// result is trimmed of surrounding whitespace.
+func resolvePlaceholders(repl *caddy.Replacer, name string, value string) (string, error) {
+	result, err := repl.ReplaceOrErr(value, true, true)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", name, err)
+	}
+	return strings.TrimSpace(result), nil
+}
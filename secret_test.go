@@ -0,0 +1,113 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileTokenRereadsOnChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("first-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	source := newFileToken(path)
+	if tok, err := source.token(); err != nil || tok != "first-token" {
+		t.Fatalf("Expected first-token, got %q (%v)", tok, err)
+	}
+	if err := os.WriteFile(path, []byte("second-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// make sure the change is visible even on coarse-grained filesystems
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if tok, err := source.token(); err != nil || tok != "second-token" {
+		t.Errorf("Expected second-token, got %q (%v)", tok, err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if tok, err := source.token(); err != nil || tok != "second-token" {
+		t.Errorf("Expected fallback to second-token, got %q (%v)", tok, err)
+	}
+}
+
+func TestFileTokenMissing(t *testing.T) {
+	source := newFileToken(filepath.Join(t.TempDir(), "missing"))
+	if _, err := source.token(); err == nil {
+		t.Errorf("Expected an error for a missing token file")
+	}
+}
+
+func TestProvisionResolvesPlaceholders(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "db-name")
+	if err := os.WriteFile(path, []byte("FileDatabase\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TRACKER_TEST_ENDPOINT", "https://influx.example.com")
+	t.Setenv("TRACKER_TEST_TOKEN", "env-token")
+	m := AdobeUsageTracker{
+		Endpoint: "{env.TRACKER_TEST_ENDPOINT}",
+		Database: "{file." + path + "}",
+		Policy:   "autogen",
+		Token:    "{env.TRACKER_TEST_TOKEN}",
+		Position: "first",
+	}
+	if err := m.Provision(caddy.Context{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	defer func() { _ = m.Cleanup() }()
+	if m.ep != "https://influx.example.com" || m.db != "FileDatabase" {
+		t.Errorf("Placeholders not resolved: endpoint %q, database %q", m.ep, m.db)
+	}
+	if tok, _ := m.tok.token(); tok != "env-token" {
+		t.Errorf("Expected env-token, got %q", tok)
+	}
+	if err := m.Validate(); err != nil {
+		t.Errorf("Validate failed: %v", err)
+	}
+}
+
+func TestProvisionTokenErrors(t *testing.T) {
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenPath, []byte("file-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	base := AdobeUsageTracker{
+		Endpoint: "https://influx.example.com",
+		Database: "db",
+		Policy:   "autogen",
+		Position: "first",
+	}
+	both := base
+	both.Token, both.TokenFile = "tok", tokenPath
+	unset := base
+	unset.Token = "{env.TRACKER_TEST_UNSET_VARIABLE}"
+	missing := base
+	missing.TokenFile = tokenPath + ".missing"
+	for name, m := range map[string]AdobeUsageTracker{"both": both, "unset": unset, "missing": missing} {
+		if err := m.Provision(caddy.Context{}); err == nil {
+			t.Errorf("%s: expected a provisioning error", name)
+		}
+	}
+	good := base
+	good.TokenFile = tokenPath
+	if err := good.Provision(caddy.Context{}); err != nil {
+		t.Fatalf("Provision with token_file failed: %v", err)
+	}
+	defer func() { _ = good.Cleanup() }()
+	if tok, _ := good.tok.token(); tok != "file-token" {
+		t.Errorf("Expected file-token, got %q", tok)
+	}
+}
@@ -0,0 +1,264 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"io/fs"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// storeFlushEvery is how often sessions added to a store
+	// are written to its file.
+	storeFlushEvery = time.Second
+	// storeCompactEvery is how often a store's file is compacted.
+	storeCompactEvery = time.Hour
+)
+
+// A sessionStore keeps every session a tracker parses in a local
+// file, so that reports can be generated without querying Influx.
+// The file holds one JSON session per line. Sessions added to the
+// store are buffered, and written to the file in the background,
+// so a split session appears more than once until the store is
+// compacted (which happens when it is opened, and every hour).
+// If the store has a retention, compacting it also drops the
+// sessions launched longer ago than that.
+type sessionStore struct {
+	path string
+
+	mu        sync.Mutex
+	file      *os.File
+	pending   bytes.Buffer
+	retention time.Duration
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// Trackers share the store for a given path, so that a config
+// reload doesn't compact a store that is still being appended to.
+var sessionStores = caddy.NewUsagePool()
+
+// loadSessionStore returns the open store for path, opening it if
+// no tracker is using it, and sets its retention (so a config reload
+// that changes the retention changes it). Each call must be matched
+// by a call to releaseSessionStore.
+func loadSessionStore(path string, retention time.Duration) (*sessionStore, error) {
+	value, _, err := sessionStores.LoadOrNew(path, func() (caddy.Destructor, error) {
+		return openSessionStore(path, retention)
+	})
+	if err != nil {
+		return nil, err
+	}
+	store := value.(*sessionStore)
+	store.mu.Lock()
+	store.retention = retention
+	store.mu.Unlock()
+	return store, nil
+}
+
+// releaseSessionStore releases a tracker's use of the store
+// for path, closing it if no other tracker is using it.
+func releaseSessionStore(path string) error {
+	_, err := sessionStores.Delete(path)
+	return err
+}
+
+// openSessionStore compacts the store at path (creating it
+// if necessary), opens it for appending new sessions, and
+// starts writing the sessions added to it in the background.
+func openSessionStore(path string, retention time.Duration) (*sessionStore, error) {
+	s := &sessionStore{path: path, retention: retention, stop: make(chan struct{}), done: make(chan struct{})}
+	if err := s.compact(time.Now()); err != nil {
+		return nil, err
+	}
+	go s.run(caddy.Log())
+	return s, nil
+}
+
+// add buffers the given sessions, to be appended to the store
+// in the background.
+func (s *sessionStore) add(sessions []logSession) error {
+	if len(sessions) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, session := range sessions {
+		if err := enc.Encode(session); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending.Write(buf.Bytes())
+	return nil
+}
+
+// run writes added sessions to the store and compacts it
+// periodically, until the store is destructed.
+func (s *sessionStore) run(logger *zap.Logger) {
+	defer close(s.done)
+	flush := time.NewTicker(storeFlushEvery)
+	defer flush.Stop()
+	compact := time.NewTicker(storeCompactEvery)
+	defer compact.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-flush.C:
+			if err := s.flush(); err != nil {
+				logger.Error("AdobeUsageTracker: failed to write session store", zap.Error(err))
+			}
+		case now := <-compact.C:
+			if err := s.compact(now); err != nil {
+				logger.Error("AdobeUsageTracker: failed to compact session store", zap.Error(err))
+			}
+		}
+	}
+}
+
+// flush appends the buffered sessions to the store's file.
+func (s *sessionStore) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flushLocked()
+}
+
+func (s *sessionStore) flushLocked() error {
+	if s.pending.Len() == 0 {
+		return nil
+	}
+	_, err := s.file.Write(s.pending.Bytes())
+	s.pending.Reset()
+	return err
+}
+
+// compact rewrites the store's file with its distinct sessions,
+// dropping those older than the retention (if any), and reopens
+// it for appending.
+func (s *sessionStore) compact(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file != nil {
+		if err := s.flushLocked(); err != nil {
+			return err
+		}
+	}
+	sessions, err := readSessionStore(s.path)
+	if err != nil {
+		return err
+	}
+	if s.retention > 0 {
+		cutoff := now.Add(-s.retention)
+		sessions = slices.DeleteFunc(sessions, func(session logSession) bool {
+			return session.launchTime.Before(cutoff)
+		})
+	}
+	if err := writeSessionStore(s.path, sessions); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if s.file != nil {
+		_ = s.file.Close()
+	}
+	s.file = file
+	return nil
+}
+
+// sessions returns the distinct sessions in the store.
+func (s *sessionStore) sessions() ([]logSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flushLocked(); err != nil {
+		return nil, err
+	}
+	return readSessionStore(s.path)
+}
+
+// Destruct implements caddy.Destructor. It writes any buffered
+// sessions before closing the store.
+func (s *sessionStore) Destruct() error {
+	close(s.stop)
+	<-s.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return errors.Join(s.flushLocked(), s.file.Close())
+}
+
+// readSessionStore reads the store at path and returns its distinct
+// sessions, ordered by launch time. A missing store is empty, and
+// lines that can't be decoded (such as a last line that was only
+// partly written when the server was stopped) are skipped.
+func readSessionStore(path string) ([]logSession, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	merged := make(map[string]logSession)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var session logSession
+		if err := json.Unmarshal(scanner.Bytes(), &session); err != nil || session.sessionId == "" {
+			continue
+		}
+		if prior, ok := merged[session.sessionId]; ok {
+			session = mergeSession(prior, session)
+		}
+		merged[session.sessionId] = session
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sessions := make([]logSession, 0, len(merged))
+	for _, session := range merged {
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].launchTime.Equal(sessions[j].launchTime) {
+			return sessions[i].launchTime.Before(sessions[j].launchTime)
+		}
+		return sessions[i].sessionId < sessions[j].sessionId
+	})
+	return sessions, nil
+}
+
+// writeSessionStore atomically replaces the store at path
+// with one containing the given sessions.
+func writeSessionStore(path string, sessions []logSession) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, session := range sessions {
+		if err := enc.Encode(session); err != nil {
+			return err
+		}
+	}
+	temp := path + ".tmp"
+	if err := os.WriteFile(temp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
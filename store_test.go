@@ -0,0 +1,140 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionStoreMergesAndCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.jsonl")
+	store, err := loadSessionStore(path, 0)
+	if err != nil {
+		t.Fatalf("loadSessionStore failed: %v", err)
+	}
+	for _, name := range []string{"indesign-split-session-1-1.txt", "indesign-split-session-1-2.txt", "indesign-single-session-1.txt"} {
+		if err := store.add(parseLogFile(t, filepath.Join("testdata", name))); err != nil {
+			t.Fatalf("add failed: %v", err)
+		}
+	}
+	if again, err := loadSessionStore(path, 0); err != nil || again != store {
+		t.Errorf("Expected the open store to be shared (%v)", err)
+	} else if err := releaseSessionStore(path); err != nil {
+		t.Fatal(err)
+	}
+	sessions, err := store.sessions()
+	if err != nil || len(sessions) != 2 {
+		t.Fatalf("Expected 2 distinct sessions, got %d (%v)", len(sessions), err)
+	}
+	split := parseLogFile(t, "testdata/indesign-split-session-1-2.txt")[0]
+	for _, session := range sessions {
+		if session.sessionId == split.sessionId && (session.launchDuration != split.launchDuration || session.appId == "") {
+			t.Errorf("Split session not merged: %+v", session)
+		}
+	}
+	// simulate a crash in the middle of writing a session
+	if err := releaseSessionStore(path); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = file.WriteString(`{"sessionId": "partial`)
+	_ = file.Close()
+	store, err = loadSessionStore(path, 0)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer func() { _ = releaseSessionStore(path) }()
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(buf)), "\n"); len(lines) != 2 {
+		t.Errorf("Expected compacted store with 2 lines, got:\n%s", buf)
+	}
+}
+
+func TestSessionStoreWritesInBackground(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.jsonl")
+	store, err := loadSessionStore(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.add(parseLogFile(t, "testdata/indesign-single-session-1.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := os.ReadFile(path); err != nil || len(buf) != 0 {
+		t.Errorf("Expected the session to be buffered, got %q (%v)", buf, err)
+	}
+	for deadline := time.Now().Add(5 * storeFlushEvery); ; time.Sleep(10 * time.Millisecond) {
+		if buf, _ := os.ReadFile(path); len(buf) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Session was not written in the background")
+		}
+	}
+	// sessions still buffered when the store is closed are written
+	if err := store.add(parseLogFile(t, "testdata/indesign-single-session-2.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := releaseSessionStore(path); err != nil {
+		t.Fatal(err)
+	}
+	if sessions, err := readSessionStore(path); err != nil || len(sessions) != 2 {
+		t.Errorf("Expected 2 sessions written, got %d (%v)", len(sessions), err)
+	}
+}
+
+func TestSessionStoreRetention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.jsonl")
+	now := time.Now()
+	sessions := []logSession{
+		{sessionId: "old", launchTime: now.AddDate(0, 0, -40)},
+		{sessionId: "recent", launchTime: now.AddDate(0, 0, -2)},
+	}
+	if err := writeSessionStore(path, sessions); err != nil {
+		t.Fatal(err)
+	}
+	store, err := loadSessionStore(path, 30*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = releaseSessionStore(path) }()
+	if stored, err := store.sessions(); err != nil || len(stored) != 1 || stored[0].sessionId != "recent" {
+		t.Errorf("Expected the old session to be dropped on open, got %+v (%v)", stored, err)
+	}
+	// periodic compaction drops sessions that have aged out since
+	if err := store.compact(now.AddDate(0, 0, 29)); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := store.sessions(); err != nil || len(stored) != 0 {
+		t.Errorf("Expected compaction to drop the aged session, got %+v (%v)", stored, err)
+	}
+}
+
+func TestSessionStoreCaddyfile(t *testing.T) {
+	var m AdobeUsageTracker
+	if err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`adobe_usage_tracker {
+		session_store /tmp/sessions.jsonl
+		session_retention 90d
+	}`)); err != nil || m.SessionStore != "/tmp/sessions.jsonl" || m.SessionRetention != caddy.Duration(90*24*time.Hour) {
+		t.Errorf("Unexpected config: %+v (%v)", m, err)
+	}
+	m = AdobeUsageTracker{DryRun: true, SessionRetention: caddy.Duration(time.Hour), Position: "first"}
+	if err := m.Provision(caddy.Context{}); err == nil {
+		t.Errorf("Expected session_retention without session_store to fail")
+	}
+}
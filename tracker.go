@@ -9,22 +9,31 @@ package tracker
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
 	"go.uber.org/zap"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func init() {
 	caddy.RegisterModule(AdobeUsageTracker{})
+	caddy.RegisterModule(trackerAdmin{})
+	caddy.RegisterModule(UsageApp{})
 	httpcaddyfile.RegisterHandlerDirective("adobe_usage_tracker", parseCaddyfile)
+	httpcaddyfile.RegisterGlobalOption("adobe_usage", parseAppOption)
 }
 
 // AdobeUsageTracker implements HTTP middleware that parses
@@ -39,6 +48,82 @@ func init() {
 // - the retention policy of the influx v1 database
 // - an API token authorized for writes of the database
 //
+// The token can be given directly or read from a file (which is
+// re-read whenever it changes). Any of these values may use Caddy's
+// global {env.*} and {file.*} placeholders, which are resolved when
+// the tracker is provisioned, so secrets need not appear in configs.
+//
+// Instead of giving its own Influx (or dry run), retry, and dedupe
+// settings, a tracker can name a Pipeline configured in the
+// adobe_usage app, so that trackers in different sites share it.
+//
+// Only requests with one of the given Methods (default POST) are
+// parsed, and only if they match one of the Paths and ContentTypes
+// (if given) and have a length between MinLength and MaxLength (if
+// given). Other requests are passed on without reading their body.
+//
+// Uploads that fail because Influx is rate-limiting or temporarily
+// unavailable are retried with exponential backoff for up to
+// MaxRetryTime (default two minutes, negative to disable retries).
+// If BreakerThreshold uploads in a row fail that way, the endpoint
+// is considered down, and uploads are dropped without being tried
+// until BreakerCooldown has passed and a probe upload succeeds.
+//
+// If VerifyOnStart is set, the Influx settings are checked against
+// the endpoint when the tracker is provisioned, so that a bad token,
+// database, or policy is a configuration error rather than showing
+// up later as failed uploads.
+//
+// If DryRun is set, sessions are parsed as usual but never uploaded.
+// Instead, the line protocol that would have been uploaded is logged
+// or, if DryRunFile is set, appended to that file. In this mode the
+// Influx settings are optional, since the endpoint is never contacted.
+//
+// If SessionStore is set, every parsed session is also kept in that
+// file, which is used for license utilization and other reports.
+// Sessions are written to the file in the background, and the file
+// is compacted hourly; if SessionRetention is set, compacting it
+// also drops sessions launched longer ago than that.
+// With a session store, a ConcurrencyInterval (such as 1h) makes
+// the tracker periodically upload the peak number of concurrent
+// sessions per app per day, where days begin at midnight in the
+// tracker's Timezone (default UTC).
+//
+// If ComponentTimeline is set, the tracker also uploads, for each
+// session, a summary of the log activity of each NGL component.
+//
+// If HttpCalls is set, it also uploads a record of each of the
+// licensing-related network calls that NGL logged in each session.
+//
+// If DailyRollup is set, the tracker also keeps per-day statistics
+// for each app, version, OS, and site (sites are named ranges of
+// client addresses) and uploads them when each day closes. The
+// statistics are kept in memory, so unless there is a SessionStore
+// to rebuild them from, a restart loses the days not yet uploaded.
+//
+// Sessions are tagged with the product name, family, and release
+// year of their app, using a builtin table of Adobe products that
+// Products (keyed by NGL AppID or ClientID) can extend or override.
+//
+// If a VersionPolicy is given, launches of app, NGL, or OS versions
+// below the policy's minimums are reported to its webhook.
+//
+// At most MaxUploads (default 100) uploads, counting daily rollup
+// updates and version alerts, are in progress at once; uploads
+// beyond that (for example, while Influx is slow or down) are
+// dropped rather than left to pile up. Sessions are still added
+// to the daily rollup, and dropped version alerts are sent the
+// next time their violation is seen.
+//
+// If Dedupe is set, the tracker remembers (up to) that many of the
+// uploads and sessions it has emitted, and doesn't emit them again
+// when a client retries an upload. If DedupeFile is also set, what
+// it remembers is saved there when Caddy stops.
+//
+// If ArchiveDir is set, a compressed copy of every uploaded body is
+// kept there (for ArchiveRetention, if set), so that sessions can
+// later be re-derived with an improved parser by the replay command.
+//
 // Note: this middleware uses the v1 HTTP write API because it's
 // fully supported by both v1 and v3 databases.  When using a
 // v3 database, you must specify a "dbrp" mapping from the
@@ -47,19 +132,78 @@ func init() {
 //
 // https://docs.influxdata.com/influxdb/cloud-serverless/write-data/api/v1-http/
 type AdobeUsageTracker struct {
-	Endpoint string `json:"endpoint,omitempty"`
-	Database string `json:"database,omitempty"`
-	Policy   string `json:"policy,omitempty"`
-	Token    string `json:"token,omitempty"`
-	Header   string `json:"header,omitempty"`
-	Position string `json:"position,omitempty"`
-
-	ep  string
-	db  string
-	rp  string
-	tok string
-	hdr string
-	pos string
+	Endpoint  string `json:"endpoint,omitempty"`
+	Database  string `json:"database,omitempty"`
+	Policy    string `json:"policy,omitempty"`
+	Token     string `json:"token,omitempty"`
+	TokenFile string `json:"token_file,omitempty"`
+	Header    string `json:"header,omitempty"`
+	Position  string `json:"position,omitempty"`
+	Pipeline  string `json:"pipeline,omitempty"`
+
+	Methods      []string `json:"methods,omitempty"`
+	Paths        []string `json:"paths,omitempty"`
+	ContentTypes []string `json:"content_types,omitempty"`
+	MinLength    int64    `json:"min_length,omitempty"`
+	MaxLength    int64    `json:"max_length,omitempty"`
+
+	MaxRetryTime     caddy.Duration `json:"max_retry_time,omitempty"`
+	BreakerThreshold int            `json:"breaker_threshold,omitempty"`
+	BreakerCooldown  caddy.Duration `json:"breaker_cooldown,omitempty"`
+	MaxUploads       int            `json:"max_uploads,omitempty"`
+
+	RecentSessions int  `json:"recent_sessions,omitempty"`
+	VerifyOnStart  bool `json:"verify_on_start,omitempty"`
+
+	DryRun     bool   `json:"dry_run,omitempty"`
+	DryRunFile string `json:"dry_run_file,omitempty"`
+
+	SessionStore        string         `json:"session_store,omitempty"`
+	SessionRetention    caddy.Duration `json:"session_retention,omitempty"`
+	Timezone            string         `json:"timezone,omitempty"`
+	ConcurrencyInterval caddy.Duration `json:"concurrency_interval,omitempty"`
+
+	ComponentTimeline bool `json:"component_timeline,omitempty"`
+	HttpCalls         bool `json:"http_calls,omitempty"`
+
+	DailyRollup bool                `json:"daily_rollup,omitempty"`
+	Sites       map[string][]string `json:"sites,omitempty"`
+
+	Products      map[string]ProductInfo `json:"products,omitempty"`
+	VersionPolicy *VersionPolicy         `json:"version_policy,omitempty"`
+
+	Dedupe     int    `json:"dedupe,omitempty"`
+	DedupeFile string `json:"dedupe_file,omitempty"`
+
+	ArchiveDir       string         `json:"archive_dir,omitempty"`
+	ArchiveRetention caddy.Duration `json:"archive_retention,omitempty"`
+
+	ep   string
+	db   string
+	rp   string
+	tok  tokenSource
+	hdr  string
+	pos  string
+	sink lineSink
+
+	uploads uploadLimit
+	filter  *requestFilter
+
+	archive *bodyArchive
+	dryRun  *os.File
+	store   *sessionStore
+	loc     *time.Location
+	stop    chan struct{}
+
+	rollup    *dailyRollup
+	rollupKey string
+	products  productTable
+
+	dedupe    *dedupeCache
+	dedupeKey string
+
+	id    int
+	stats *trackerStats
 }
 
 // CaddyModule returns the Caddy module information.
@@ -71,50 +215,345 @@ func (AdobeUsageTracker) CaddyModule() caddy.ModuleInfo {
 }
 
 // Provision implements caddy.Provisioner.
-func (m *AdobeUsageTracker) Provision(caddy.Context) error {
-	if m.Endpoint == "" {
+func (m *AdobeUsageTracker) Provision(ctx caddy.Context) error {
+	if m.Pipeline != "" {
+		if err := m.attachPipeline(ctx); err != nil {
+			return err
+		}
+	} else if err := m.provisionOutput(); err != nil {
+		return err
+	}
+	m.hdr = m.Header
+	switch strings.ToLower(m.Position) {
+	case "first":
+		m.pos = "first"
+	case "last":
+		m.pos = "last"
+	default:
+		return fmt.Errorf("Position must be \"first\" or \"last\", found %q", m.Position)
+	}
+	filter, err := newRequestFilter(m.Methods, m.Paths, m.ContentTypes, m.MinLength, m.MaxLength)
+	if err != nil {
+		return err
+	}
+	m.filter = filter
+	if m.ArchiveDir != "" {
+		dir, err := resolvePlaceholders(caddy.NewReplacer(), "archive_dir", m.ArchiveDir)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("cannot create archive directory: %v", err)
+		}
+		m.archive = newBodyArchive(dir, time.Duration(m.ArchiveRetention))
+	} else if m.ArchiveRetention != 0 {
+		return fmt.Errorf("archive_retention requires an archive_dir")
+	}
+	if m.SessionStore != "" {
+		path, err := resolvePlaceholders(caddy.NewReplacer(), "session_store", m.SessionStore)
+		if err != nil {
+			return err
+		}
+		if m.SessionRetention < 0 {
+			return fmt.Errorf("session_retention cannot be negative")
+		}
+		if m.store, err = loadSessionStore(path, time.Duration(m.SessionRetention)); err != nil {
+			return fmt.Errorf("cannot open session store: %v", err)
+		}
+	} else if m.SessionRetention != 0 {
+		return fmt.Errorf("session_retention requires a session_store")
+	}
+	loc, err := loadTimezone(m.Timezone)
+	if err != nil {
+		return err
+	}
+	m.loc = loc
+	m.stop = make(chan struct{})
+	if m.ConcurrencyInterval > 0 {
+		if m.store == nil {
+			return fmt.Errorf("concurrency_interval requires a session_store")
+		}
+		go m.runConcurrency(time.Duration(m.ConcurrencyInterval), m.stop)
+	}
+	if m.DailyRollup {
+		if err := m.provisionRollup(); err != nil {
+			return err
+		}
+	} else if len(m.Sites) > 0 {
+		return fmt.Errorf("sites require daily_rollup")
+	}
+	if len(m.Products) > 0 {
+		products, err := newProductTable(m.Products)
+		if err != nil {
+			return err
+		}
+		m.products = products
+	}
+	if m.VersionPolicy != nil {
+		if err := m.VersionPolicy.provision(); err != nil {
+			return err
+		}
+	}
+	m.stats = newTrackerStats(m.RecentSessions)
+	m.id = registerTracker(m)
+	return nil
+}
+
+// provisionOutput sets up the tracker's own upload pipeline: its
+// Influx settings (or dry run), upload sink, and dedupe cache.
+func (m *AdobeUsageTracker) provisionOutput() error {
+	if m.DryRun && m.VerifyOnStart {
+		return fmt.Errorf("verify_on_start cannot be used with dry_run")
+	}
+	if m.DryRunFile != "" && !m.DryRun {
+		return fmt.Errorf("dry_run_file requires dry_run")
+	}
+	if !m.DryRun {
+		if err := m.provisionInflux(); err != nil {
+			return err
+		}
+	}
+	if m.BreakerThreshold < 0 {
+		return fmt.Errorf("breaker threshold cannot be negative")
+	}
+	if m.MaxUploads < 0 {
+		return fmt.Errorf("max_uploads cannot be negative")
+	}
+	m.uploads = newUploadLimit(m.MaxUploads)
+	if m.VerifyOnStart {
+		if _, err := m.verifyInflux(); err != nil {
+			return fmt.Errorf("influx check failed: %w", err)
+		}
+	}
+	if err := m.provisionSink(); err != nil {
+		return err
+	}
+	if m.Dedupe > 0 {
+		if err := m.provisionDedupe(); err != nil {
+			return err
+		}
+	} else if m.Dedupe < 0 {
+		return fmt.Errorf("dedupe size cannot be negative")
+	} else if m.DedupeFile != "" {
+		return fmt.Errorf("dedupe_file requires dedupe")
+	}
+	return nil
+}
+
+// releaseOutput releases what provisionOutput set up.
+func (m *AdobeUsageTracker) releaseOutput() error {
+	var errs []error
+	if m.dedupeKey != "" {
+		errs = append(errs, releaseDedupeCache(m.dedupeKey))
+	}
+	if m.dryRun != nil {
+		errs = append(errs, m.dryRun.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// destination identifies where the tracker's uploads go, so
+// that trackers with the same destination can share state.
+func (m *AdobeUsageTracker) destination() string {
+	if m.Pipeline != "" {
+		return "pipeline|" + m.Pipeline
+	}
+	return fmt.Sprintf("%s|%s|%s|%t|%s", m.ep, m.db, m.rp, m.DryRun, m.DryRunFile)
+}
+
+// provisionSink sets up where the tracker's sessions go: to
+// Influx, via a circuit breaker, or (in a dry run) to the
+// dry-run file or the log.
+func (m *AdobeUsageTracker) provisionSink() error {
+	if !m.DryRun {
+		influx := newInfluxSink(m.ep, m.db, m.rp, m.tok, newRetryPolicy(time.Duration(m.MaxRetryTime)))
+		m.sink = newCircuitBreaker(influx, m.BreakerThreshold, time.Duration(m.BreakerCooldown))
+		return nil
+	}
+	if m.DryRunFile == "" {
+		m.sink = logSink{}
+		return nil
+	}
+	path, err := resolvePlaceholders(caddy.NewReplacer(), "dry_run_file", m.DryRunFile)
+	if err != nil {
+		return err
+	}
+	m.dryRun, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot open dry run file: %v", err)
+	}
+	m.sink = &writerSink{w: m.dryRun}
+	return nil
+}
+
+// provisionRollup attaches the tracker to the daily rollup shared
+// by trackers with the same destination, timezone, and sites.
+func (m *AdobeUsageTracker) provisionRollup() error {
+	sites, err := newSiteTable(m.Sites)
+	if err != nil {
+		return err
+	}
+	siteJSON, err := json.Marshal(m.Sites)
+	if err != nil {
+		return err
+	}
+	m.rollupKey = fmt.Sprintf("%s|%s|%s", m.destination(), m.loc, siteJSON)
+	m.rollup, err = loadDailyRollup(m.rollupKey, m.loc, sites, m.sink, m.store)
+	return err
+}
+
+// provisionDedupe attaches the tracker to the dedupe cache shared
+// by trackers with the same destination and dedupe file.
+func (m *AdobeUsageTracker) provisionDedupe() error {
+	var path string
+	if m.DedupeFile != "" {
+		var err error
+		if path, err = resolvePlaceholders(caddy.NewReplacer(), "dedupe_file", m.DedupeFile); err != nil {
+			return err
+		}
+	}
+	key := fmt.Sprintf("%s|%s", m.destination(), path)
+	dedupe, err := loadDedupeCache(key, m.Dedupe, path)
+	if err != nil {
+		return err
+	}
+	m.dedupe, m.dedupeKey = dedupe, key
+	return nil
+}
+
+// loadTimezone returns the location with the given name,
+// which defaults to UTC.
+func loadTimezone(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %q: %v", name, err)
+	}
+	return loc, nil
+}
+
+// provisionInflux validates the Influx endpoint, database, policy,
+// and token settings. Global placeholders such as {env.*} and
+// {file.*} in any of those settings are resolved here.
+func (m *AdobeUsageTracker) provisionInflux() error {
+	repl := caddy.NewReplacer()
+	endpoint, err := resolvePlaceholders(repl, "endpoint", m.Endpoint)
+	if err != nil {
+		return err
+	}
+	if endpoint == "" {
 		return fmt.Errorf("an endpoint URL must be specified")
 	}
-	u, err := url.Parse(m.Endpoint)
+	u, err := url.Parse(endpoint)
 	if err != nil {
-		return fmt.Errorf("%q is not a valid endpoint url: %v", m.Endpoint, err)
+		return fmt.Errorf("%q is not a valid endpoint url: %v", endpoint, err)
 	}
 	if u.Scheme != "https" {
 		return fmt.Errorf("endpoint protocol must be https, not '%s'", u.Scheme)
 	}
 	if u.Hostname() == "" {
-		return fmt.Errorf("endpoint %q is missing a hostname", m.Endpoint)
+		return fmt.Errorf("endpoint %q is missing a hostname", endpoint)
 	}
 	if u.Path != "" || u.RawQuery != "" || u.Fragment != "" {
-		return fmt.Errorf("endpoint %q cannot have a path, query, or fragment portion", m.Endpoint)
+		return fmt.Errorf("endpoint %q cannot have a path, query, or fragment portion", endpoint)
+	}
+	m.ep = endpoint
+	if m.db, err = resolvePlaceholders(repl, "database", m.Database); err != nil {
+		return err
 	}
-	m.ep = m.Endpoint
-	if m.Database == "" {
+	if m.db == "" {
 		return fmt.Errorf("database must be specified")
 	}
-	m.db = m.Database
-	if m.Policy == "" {
-		return fmt.Errorf("A retention policy must be specified")
+	if m.rp, err = resolvePlaceholders(repl, "policy", m.Policy); err != nil {
+		return err
 	}
-	m.rp = m.Policy
-	if m.Token == "" {
-		return fmt.Errorf("A token must be specified")
+	if m.rp == "" {
+		return fmt.Errorf("A retention policy must be specified")
 	}
-	m.tok = m.Token
-	m.hdr = m.Header
-	switch strings.ToLower(m.Position) {
-	case "first":
-		m.pos = "first"
-	case "last":
-		m.pos = "last"
-	default:
-		return fmt.Errorf("Position must be \"first\" or \"last\", found %q", m.Position)
+	if m.tok, err = m.provisionToken(repl); err != nil {
+		return err
 	}
 	return nil
 }
 
+// Cleanup implements caddy.CleanerUpper.
+func (m *AdobeUsageTracker) Cleanup() error {
+	unregisterTracker(m.id)
+	if m.stop != nil {
+		close(m.stop)
+	}
+	var errs []error
+	if m.rollup != nil {
+		errs = append(errs, releaseDailyRollup(m.rollupKey))
+	}
+	if m.store != nil {
+		errs = append(errs, releaseSessionStore(m.store.path))
+	}
+	errs = append(errs, m.releaseOutput())
+	return errors.Join(errs...)
+}
+
+// redacted returns a copy of the tracker's configuration that
+// is safe to display, because its token has been redacted.
+func (m *AdobeUsageTracker) redacted() AdobeUsageTracker {
+	config := *m
+	if config.Token != "" {
+		config.Token = "REDACTED"
+	}
+	if p := config.VersionPolicy; p != nil {
+		config.VersionPolicy = &VersionPolicy{
+			MinAppVersions: p.MinAppVersions,
+			MinNglVersion:  p.MinNglVersion,
+			MinOsVersions:  p.MinOsVersions,
+			WebhookURL:     "REDACTED",
+			WebhookFormat:  p.WebhookFormat,
+			DedupWindow:    p.DedupWindow,
+		}
+	}
+	return config
+}
+
+// provisionToken returns the token source specified by either
+// the token or the token_file value (but not both). A token file
+// must be readable now, even though it will be re-read later.
+func (m *AdobeUsageTracker) provisionToken(repl *caddy.Replacer) (tokenSource, error) {
+	if m.Token != "" && m.TokenFile != "" {
+		return nil, fmt.Errorf("specify a token or a token_file, not both")
+	}
+	if m.TokenFile != "" {
+		path, err := resolvePlaceholders(repl, "token_file", m.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		source := newFileToken(path)
+		if _, err := source.token(); err != nil {
+			return nil, err
+		}
+		return source, nil
+	}
+	tok, err := resolvePlaceholders(repl, "token", m.Token)
+	if err != nil {
+		return nil, err
+	}
+	if tok == "" {
+		return nil, fmt.Errorf("A token or token_file must be specified")
+	}
+	return staticToken(tok), nil
+}
+
 // Validate implements caddy.Validator.
 func (m *AdobeUsageTracker) Validate() error {
+	if m.pos != "first" && m.pos != "last" {
+		return fmt.Errorf("position must be \"first\" or \"last\"")
+	}
+	if m.sink == nil {
+		return fmt.Errorf("tracker has not been provisioned")
+	}
+	if m.DryRun || m.Pipeline != "" {
+		return nil
+	}
 	if m.ep == "" {
 		return fmt.Errorf("endpoint URL must be specified")
 	}
@@ -137,12 +576,9 @@ func (m *AdobeUsageTracker) Validate() error {
 	if m.rp == "" {
 		return fmt.Errorf("retention policy must be specified")
 	}
-	if m.tok == "" {
+	if m.tok == nil {
 		return fmt.Errorf("token must be specified")
 	}
-	if m.pos != "first" && m.pos != "last" {
-		return fmt.Errorf("position must be \"first\" or \"last\"")
-	}
 	return nil
 }
 
@@ -155,6 +591,66 @@ func (m *AdobeUsageTracker) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	m.Position = "first"
 	for nesting := d.Nesting(); d.NextBlock(nesting); {
 		key := d.Val()
+		if key == "verify_on_start" {
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.VerifyOnStart = true
+			continue
+		}
+		if key == "version_policy" {
+			policy, err := unmarshalVersionPolicy(d)
+			if err != nil {
+				return err
+			}
+			m.VersionPolicy = policy
+			continue
+		}
+		if key == "component_timeline" {
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.ComponentTimeline = true
+			continue
+		}
+		if key == "http_calls" {
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.HttpCalls = true
+			continue
+		}
+		if key == "daily_rollup" {
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.DailyRollup = true
+			continue
+		}
+		if key == "dedupe" {
+			m.Dedupe = defaultDedupeSize
+			if d.NextArg() {
+				n, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid dedupe size %q: %v", d.Val(), err)
+				}
+				m.Dedupe = n
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			continue
+		}
+		if key == "dry_run" {
+			m.DryRun = true
+			if d.NextArg() {
+				m.DryRunFile = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			continue
+		}
 		if !d.NextArg() {
 			return d.ArgErr()
 		}
@@ -167,10 +663,120 @@ func (m *AdobeUsageTracker) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			m.Policy = d.Val()
 		case "token":
 			m.Token = d.Val()
+		case "token_file":
+			m.TokenFile = d.Val()
 		case "header":
 			m.Header = d.Val()
 		case "position":
 			m.Position = d.Val()
+		case "pipeline":
+			m.Pipeline = d.Val()
+		case "methods":
+			m.Methods = append(append(m.Methods, d.Val()), d.RemainingArgs()...)
+		case "paths":
+			m.Paths = append(append(m.Paths, d.Val()), d.RemainingArgs()...)
+		case "content_types":
+			m.ContentTypes = append(append(m.ContentTypes, d.Val()), d.RemainingArgs()...)
+		case "min_length":
+			n, err := humanize.ParseBytes(d.Val())
+			if err != nil {
+				return d.Errf("invalid min_length %q: %v", d.Val(), err)
+			}
+			m.MinLength = int64(n)
+		case "max_length":
+			n, err := humanize.ParseBytes(d.Val())
+			if err != nil {
+				return d.Errf("invalid max_length %q: %v", d.Val(), err)
+			}
+			m.MaxLength = int64(n)
+		case "recent_sessions":
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid recent_sessions %q: %v", d.Val(), err)
+			}
+			m.RecentSessions = n
+		case "max_retry_time":
+			if d.Val() == "off" {
+				m.MaxRetryTime = -1
+				break
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid max_retry_time %q: %v", d.Val(), err)
+			}
+			m.MaxRetryTime = caddy.Duration(dur)
+		case "breaker_threshold":
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid breaker_threshold %q: %v", d.Val(), err)
+			}
+			m.BreakerThreshold = n
+		case "max_uploads":
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid max_uploads %q: %v", d.Val(), err)
+			}
+			m.MaxUploads = n
+		case "session_store":
+			m.SessionStore = d.Val()
+		case "site":
+			name := d.Val()
+			ranges := d.RemainingArgs()
+			if len(ranges) == 0 {
+				return d.ArgErr()
+			}
+			if m.Sites == nil {
+				m.Sites = make(map[string][]string)
+			}
+			m.Sites[name] = append(m.Sites[name], ranges...)
+		case "product":
+			id := d.Val()
+			args := d.RemainingArgs()
+			if len(args) != 2 && len(args) != 3 {
+				return d.ArgErr()
+			}
+			info := ProductInfo{Name: args[0], Family: args[1]}
+			if len(args) == 3 {
+				n, err := strconv.Atoi(args[2])
+				if err != nil {
+					return d.Errf("invalid year offset %q for product %s: %v", args[2], id, err)
+				}
+				info.YearOffset = n
+			}
+			if m.Products == nil {
+				m.Products = make(map[string]ProductInfo)
+			}
+			m.Products[id] = info
+		case "timezone":
+			m.Timezone = d.Val()
+		case "concurrency_interval":
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid concurrency_interval %q: %v", d.Val(), err)
+			}
+			m.ConcurrencyInterval = caddy.Duration(dur)
+		case "dedupe_file":
+			m.DedupeFile = d.Val()
+		case "archive_dir":
+			m.ArchiveDir = d.Val()
+		case "session_retention":
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid session_retention %q: %v", d.Val(), err)
+			}
+			m.SessionRetention = caddy.Duration(dur)
+		case "archive_retention":
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid archive_retention %q: %v", d.Val(), err)
+			}
+			m.ArchiveRetention = caddy.Duration(dur)
+		case "breaker_cooldown":
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid breaker_cooldown %q: %v", d.Val(), err)
+			}
+			m.BreakerCooldown = caddy.Duration(dur)
 		default:
 			return d.ArgErr()
 		}
@@ -188,15 +794,66 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 // ServeHTTP implements caddyhttp.MiddlewareHandler. It extracts
 // measurements from any logs uploaded in the request, sends them
 // to the influxDB endpoint, and then passes the request intact
-// onto the next handler.
+// onto the next handler. The upload happens in the background,
+// so retries of a failed upload don't delay the client. Requests
+// rejected by the tracker's filter are passed on without reading.
 func (m AdobeUsageTracker) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
 	logger := caddy.Log()
-	buf, err := io.ReadAll(r.Body)
+	if ok, reason := m.filter.accepts(r); !ok {
+		logger.Debug("AdobeUsageTracker: not parsing request",
+			zap.String("reason", reason), zap.String("method", r.Method), zap.String("path", r.URL.Path))
+		m.stats.recordSkip()
+		return next.ServeHTTP(w, r)
+	}
+	buf, ok, err := m.filter.readBody(r)
 	if err != nil {
 		return err
 	}
+	if !ok {
+		logger.Debug("AdobeUsageTracker: not parsing request",
+			zap.String("reason", "content length"), zap.String("method", r.Method), zap.String("path", r.URL.Path))
+		m.stats.recordSkip()
+		return next.ServeHTTP(w, r)
+	}
 	remoteAddr := m.parseRemoteAddr(r, logger)
-	sessions := parseLog(string(buf), remoteAddr)
+	received := time.Now()
+	if m.archive != nil && len(buf) > 0 {
+		if err := m.archive.store(received, remoteAddr, buf, logger); err != nil {
+			logger.Error("AdobeUsageTracker: failed to archive request body", zap.Error(err))
+		}
+	}
+	sessions, quality := parseLogReport(string(buf), remoteAddr)
+	agent, fromNgl := parseUploadAgent(r.UserAgent())
+	for i := range sessions {
+		if fromNgl {
+			agent.apply(&sessions[i])
+		}
+		if m.products != nil {
+			m.products.apply(&sessions[i])
+		}
+	}
+	// duplicates are found before anything is done with the sessions,
+	// so a retried upload doesn't repeat any of it
+	emit, duplicate := sessions, false
+	var emitted []dedupeEntry
+	if m.dedupe != nil && quality.fromNgl() {
+		emit, emitted, duplicate = m.dedupe.filter(buf, sessions, logger)
+		m.stats.recordDuplicates(duplicate, len(sessions)-len(emit))
+		if duplicate {
+			logger.Info("AdobeUsageTracker: ignoring a duplicate of an earlier upload")
+		}
+	}
+	m.stats.recordRequest(emit)
+	m.stats.recordParse(quality)
+	if quality.TotalLines > 0 && quality.MatchedLines == 0 {
+		logger.Warn("AdobeUsageTracker: no lines of the uploaded log were in NGL format",
+			zap.Int("line-count", quality.TotalLines))
+	}
+	if m.store != nil {
+		if err := m.store.add(emit); err != nil {
+			logger.Error("AdobeUsageTracker: failed to store sessions", zap.Error(err))
+		}
+	}
 	userAgent, err := url.QueryUnescape(r.UserAgent())
 	if err != nil {
 		userAgent = r.UserAgent()
@@ -207,15 +864,58 @@ func (m AdobeUsageTracker) ServeHTTP(w http.ResponseWriter, r *http.Request, nex
 		zap.Int("content-length", len(buf)),
 		zap.Int("session-count", len(sessions)),
 	)
-	logger.Debug("AdobeUsageTracker: uploading sessions", zap.Objects("sessions", sessions))
+	logger.Debug("AdobeUsageTracker: uploading sessions", zap.Objects("sessions", emit))
 	if len(sessions) == 0 {
-		logger.Info("AdobeUsageTracker: no sessions to upload")
-	} else {
-		err = sendSessions(m.ep, m.db, m.rp, m.tok, sessions, logger)
-		if err != nil {
-			logger.Error("AdobeUsageTracker: failed to send sessions", zap.Error(err))
-		} else {
-			logger.Info("AdobeUsageTracker: sent sessions successfully")
+		logger.Info("AdobeUsageTracker: no sessions found in request")
+	} else if len(emit) > 0 {
+		// the sessions are recorded here, so only the uploads
+		// of their results are subject to the upload limit
+		if m.rollup != nil {
+			lines := m.rollup.update(emit, received, logger)
+			if len(lines) > 0 && !m.uploads.run(func() { m.rollup.send(lines, logger) }) {
+				logger.Warn("AdobeUsageTracker: too many uploads in progress, dropped daily rollup update")
+				m.stats.recordOverload()
+			}
+		}
+		if m.VersionPolicy != nil {
+			alerts := m.VersionPolicy.alerts(emit)
+			if len(alerts) > 0 && !m.uploads.run(func() { m.VersionPolicy.send(alerts, logger) }) {
+				logger.Warn("AdobeUsageTracker: too many uploads in progress, dropped version alerts")
+				m.VersionPolicy.forget(alerts)
+				m.stats.recordOverload()
+			}
+		}
+	}
+	if quality.fromNgl() && !duplicate {
+		lines := append(sessionLines(emit, logger), qualityLine(quality, remoteAddr, received))
+		for _, s := range emit {
+			if m.ComponentTimeline {
+				lines = append(lines, componentLines(s)...)
+			}
+			if m.HttpCalls {
+				lines = append(lines, httpCallLines(s)...)
+			}
+		}
+		m.stats.startUpload()
+		uploading := m.uploads.run(func() {
+			if err := m.sink.uploadLines(lines, logger); errors.Is(err, errBreakerOpen) {
+				logger.Debug("AdobeUsageTracker: dropped sessions while upload endpoint is down")
+				m.stats.finishUpload("dropped", err)
+			} else if err != nil {
+				logger.Error("AdobeUsageTracker: failed to send sessions", zap.Error(err))
+				m.stats.finishUpload("failed", err)
+			} else {
+				logger.Info("AdobeUsageTracker: sent sessions successfully")
+				if m.dedupe != nil {
+					m.dedupe.remember(emitted)
+				}
+				m.stats.finishUpload("success", nil)
+			}
+		})
+		if !uploading {
+			logger.Warn("AdobeUsageTracker: too many uploads in progress, dropped sessions")
+			m.stats.recordOverload()
+			m.stats.finishUpload("dropped", errTooManyUploads)
 		}
 	}
 	r.Body = io.NopCloser(bytes.NewReader(buf))
@@ -272,6 +972,7 @@ func (m *AdobeUsageTracker) parseRemoteAddr(r *http.Request, l *zap.Logger) stri
 var (
 	_ caddy.Provisioner           = (*AdobeUsageTracker)(nil)
 	_ caddy.Validator             = (*AdobeUsageTracker)(nil)
+	_ caddy.CleanerUpper          = (*AdobeUsageTracker)(nil)
 	_ caddyhttp.MiddlewareHandler = (*AdobeUsageTracker)(nil)
 	_ caddyfile.Unmarshaler       = (*AdobeUsageTracker)(nil)
 )
@@ -0,0 +1,188 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"bytes"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveLog sends the named testdata log through the tracker,
+// checks that the next handler sees the intact body, and waits
+// for the tracker's background upload to finish.
+func serveLog(t *testing.T, m *AdobeUsageTracker, name string) {
+	postLog(t, m, name)
+	for deadline := time.Now().Add(5 * time.Second); m.stats.report().InFlightUploads > 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Upload did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// postLog sends the named testdata log through the tracker and
+// checks that the next handler sees the intact body.
+func postLog(t *testing.T, m *AdobeUsageTracker, name string) {
+	buf, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/ulecs/v1", bytes.NewReader(buf))
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		body, err := io.ReadAll(r.Body)
+		if err != nil || !bytes.Equal(body, buf) {
+			t.Errorf("Next handler did not get the intact body (%v)", err)
+		}
+		return nil
+	})
+	if err := m.ServeHTTP(httptest.NewRecorder(), req, next); err != nil {
+		t.Fatalf("ServeHTTP failed: %v", err)
+	}
+}
+
+// blockingSink is a lineSink whose uploads wait until it is released.
+type blockingSink struct {
+	release chan struct{}
+}
+
+func (b *blockingSink) uploadLines([]string, *zap.Logger) error {
+	<-b.release
+	return nil
+}
+
+func TestUploadLimitDropsUploads(t *testing.T) {
+	m := &AdobeUsageTracker{DryRun: true, MaxUploads: 1, Header: "X-Forwarded-For", Position: "first"}
+	if err := m.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = m.Cleanup() }()
+	sink := &blockingSink{release: make(chan struct{})}
+	m.sink = sink
+	postLog(t, m, "indesign-single-session-1.txt")
+	postLog(t, m, "indesign-single-session-2.txt")
+	if r := m.stats.report(); r.InFlightUploads != 1 || r.DroppedUploads != 1 || r.LastUploadState != "dropped" {
+		t.Errorf("Expected one upload in progress and one dropped, got %+v", r)
+	}
+	close(sink.release)
+	for deadline := time.Now().Add(5 * time.Second); len(m.uploads) > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Upload did not finish")
+		}
+	}
+	serveLog(t, m, "indesign-single-session-2.txt")
+	if r := m.stats.report(); r.DroppedUploads != 1 || r.LastUploadState != "success" {
+		t.Errorf("Expected uploads to resume once the limit allows, got %+v", r)
+	}
+}
+
+func TestUploadLimitKeepsVersionAlerts(t *testing.T) {
+	server, payloads := webhookServer(t)
+	policy := &VersionPolicy{MinAppVersions: map[string]string{"InDesign1": "99"}, WebhookURL: server.URL}
+	m := &AdobeUsageTracker{DryRun: true, DryRunFile: os.DevNull, MaxUploads: 2, VersionPolicy: policy, Header: "X-Forwarded-For", Position: "first"}
+	if err := m.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = m.Cleanup() }()
+	// with the limit reached, the alert isn't sent, but it isn't
+	// recorded as sent either, so the next launch sends it
+	m.uploads <- struct{}{}
+	m.uploads <- struct{}{}
+	postLog(t, m, "indesign-single-session-1.txt")
+	if r := m.stats.report(); r.DroppedUploads != 2 || len(policy.sent) != 0 {
+		t.Errorf("Expected dropped alert to be forgotten, got %+v and %d sent", r, len(policy.sent))
+	}
+	<-m.uploads
+	<-m.uploads
+	serveLog(t, m, "indesign-single-session-2.txt")
+	for deadline := time.Now().Add(5 * time.Second); len(payloads()) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the alert to be sent once the limit allows")
+		}
+	}
+}
+
+func TestDryRunWritesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dry-run.txt")
+	m := &AdobeUsageTracker{DryRun: true, DryRunFile: path, Header: "X-Forwarded-For", Position: "first"}
+	if err := m.Provision(caddy.Context{}); err != nil {
+		t.Fatalf("Provision without endpoint failed: %v", err)
+	}
+	defer func() { _ = m.Cleanup() }()
+	if err := m.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	serveLog(t, m, "indesign-multi-session-1-2.txt")
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "log-session,") || !strings.Contains(lines[1], `clientIp="10.0.0.1"`) {
+		t.Errorf("Unexpected dry run output:\n%s", buf)
+	}
+	if len(lines) == 3 && !strings.HasPrefix(lines[2], "parse-quality ") || !strings.Contains(lines[2], "sessions=2i,") {
+		t.Errorf("Expected a parse quality line, got %s", lines[2])
+	}
+	if r := m.stats.report(); r.LastUploadState != "success" {
+		t.Errorf("Expected successful dry run upload, got %+v", r)
+	}
+}
+
+func TestNoSessionsNoUpload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dry-run.txt")
+	m := &AdobeUsageTracker{DryRun: true, DryRunFile: path, Header: "X-Forwarded-For", Position: "first"}
+	if err := m.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = m.Cleanup() }()
+	req := httptest.NewRequest(http.MethodPost, "/ulecs/v1", strings.NewReader("{\"not\": \"a log\"}\n"))
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error { return nil })
+	if err := m.ServeHTTP(httptest.NewRecorder(), req, next); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := os.ReadFile(path); err != nil || len(buf) != 0 {
+		t.Errorf("Expected nothing uploaded for a request with no sessions, got %q (%v)", buf, err)
+	}
+	if r := m.stats.report(); r.Requests != 1 || r.ParseQuality.UnmatchedLines != 1 || r.InFlightUploads != 0 || r.LastUploadState != "" {
+		t.Errorf("Expected a parsed request with no upload, got %+v", r)
+	}
+}
+
+func TestDryRunCaddyfile(t *testing.T) {
+	var m AdobeUsageTracker
+	d := caddyfile.NewTestDispenser(`adobe_usage_tracker {
+		dry_run /tmp/lines.txt
+		verify_on_start
+	}`)
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile failed: %v", err)
+	}
+	if !m.DryRun || m.DryRunFile != "/tmp/lines.txt" || !m.VerifyOnStart {
+		t.Errorf("Unexpected config: %+v", m)
+	}
+	if err := m.Provision(caddy.Context{}); err == nil {
+		t.Errorf("Expected verify_on_start to conflict with dry_run")
+	}
+	m = AdobeUsageTracker{}
+	if err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`adobe_usage_tracker {
+		dry_run
+	}`)); err != nil || !m.DryRun || m.DryRunFile != "" {
+		t.Errorf("Expected bare dry_run, got %+v (%v)", m, err)
+	}
+}
@@ -8,6 +8,7 @@
 package tracker
 
 import (
+	"errors"
 	"fmt"
 	"github.com/caddyserver/caddy/v2"
 	"go.uber.org/zap"
@@ -15,65 +16,218 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 )
 
-// sendSessions takes an InfluxDB upload URL and a sequence of logSessions
-// and uploads the logSession data to InfluxDB.
-func sendSessions(ep string, db string, pol string, tok string, sessions []logSession, logger *zap.Logger) error {
+// A lineSink is a destination for lines of line protocol.
+type lineSink interface {
+	uploadLines(lines []string, logger *zap.Logger) error
+}
+
+// An influxSink uploads line protocol to the v1 write API of
+// an InfluxDB endpoint, retrying failed uploads per its policy.
+type influxSink struct {
+	ep     string
+	db     string
+	rp     string
+	tok    tokenSource
+	retry  retryPolicy
+	client *http.Client
+}
+
+// newInfluxSink returns a sink for the given endpoint, database,
+// retention policy, and token that uses the given retry policy.
+func newInfluxSink(ep string, db string, rp string, tok tokenSource, retry retryPolicy) *influxSink {
+	return &influxSink{ep: ep, db: db, rp: rp, tok: tok, retry: retry, client: http.DefaultClient}
+}
+
+// A writerSink writes line protocol to an io.Writer, one line
+// at a time, instead of uploading it.
+type writerSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *writerSink) uploadLines(lines []string, _ *zap.Logger) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(s.w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// defaultMaxUploads is the default limit on a tracker's uploads
+// in progress.
+const defaultMaxUploads = 100
+
+// errTooManyUploads is reported for an upload that is dropped
+// because its tracker already has too many in progress.
+var errTooManyUploads = errors.New("too many uploads in progress")
+
+// An uploadLimit bounds the number of uploads (of sessions, daily
+// rollups, or version alerts) that run in the background at once,
+// so that uploads being retried during an outage can't pile up.
+type uploadLimit chan struct{}
+
+func newUploadLimit(n int) uploadLimit {
+	if n <= 0 {
+		n = defaultMaxUploads
+	}
+	return make(uploadLimit, n)
+}
+
+// run runs f in the background and reports true, unless the limit
+// has been reached, in which case it reports false without running f.
+func (l uploadLimit) run(f func()) bool {
+	select {
+	case l <- struct{}{}:
+	default:
+		return false
+	}
+	go func() {
+		defer func() { <-l }()
+		f()
+	}()
+	return true
+}
+
+// A logSink logs line protocol instead of uploading it.
+type logSink struct{}
+
+func (logSink) uploadLines(lines []string, logger *zap.Logger) error {
+	for _, line := range lines {
+		logger.Info("AdobeUsageTracker: dry run, not uploading", zap.String("line", line))
+	}
+	return nil
+}
+
+// sendSessions takes a lineSink and a sequence of logSessions
+// and uploads the logSession data to the sink.
+func sendSessions(sink lineSink, sessions []logSession, logger *zap.Logger) error {
 	if len(sessions) == 0 {
 		return nil
 	}
-	var lines = make([]string, 0, len(sessions))
+	return sink.uploadLines(sessionLines(sessions, logger), logger)
+}
+
+// sessionLines constructs the line protocol lines for the given sessions.
+func sessionLines(sessions []logSession, logger *zap.Logger) []string {
+	var lines = make([]string, 0, len(sessions)+1)
 	for _, session := range sessions {
 		lines = append(lines, sessionLine(session, logger))
 	}
-	return uploadLines(ep, db, pol, tok, lines, logger)
+	return lines
 }
 
 // sessionLine constructs a line protocol line for the given logSession
 func sessionLine(s logSession, logger *zap.Logger) string {
-	line := fmt.Sprintf("log-session,sessionId=%s launchDuration=%d,clientIp=%q",
+	line := fmt.Sprintf("log-session,sessionId=%s launchDuration=%d,clientIp=%q,sessionComplete=%t",
 		s.sessionId,
 		s.launchDuration.Milliseconds(),
 		s.clientIp,
+		s.logTerminated,
 	)
+	if !s.lastSeen.IsZero() {
+		line = line + fmt.Sprintf(",lastSeen=%di", s.lastSeen.UnixMilli())
+	}
+	// only written when true, so that a later fragment of a split
+	// session (which has no initialization marker) doesn't erase it
+	if s.logInitialized {
+		line = line + ",logInitialized=true"
+	}
 	if s.appId != "" {
 		line = line + fmt.Sprintf(",appId=%q,appVersion=%q", s.appId, s.appVersion)
+		if v, ok := parseVersion(s.appVersion); ok {
+			line = line + v.lineFields("appVersion")
+		}
+	}
+	// product info is in fields, not tags, because fragments of a
+	// split session without an app ID have none, and all fragments
+	// must be in the same series for the last one to overwrite
+	if s.product != "" {
+		line = line + fmt.Sprintf(",product=%q,productName=%q,productFamily=%q",
+			s.product, s.productName(), s.productFamily)
+		if s.releaseYear != 0 {
+			line = line + fmt.Sprintf(",releaseYear=%di", s.releaseYear)
+		}
+	}
+	if s.clientId != "" {
+		line = line + fmt.Sprintf(",clientId=%q", s.clientId)
 	}
 	if s.appLocale != "" {
 		line = line + fmt.Sprintf(",appLocale=%q", s.appLocale)
 	}
 	if s.nglVersion != "" {
 		line = line + fmt.Sprintf(",nglVersion=%q", s.nglVersion)
+		if v, ok := parseVersion(s.nglVersion); ok {
+			line = line + v.lineFields("nglVersion")
+		}
 	}
 	if s.osName != "" {
 		line = line + fmt.Sprintf(",osName=%q,osVersion=%q", s.osName, s.osVersion)
+		if v, ok := parseVersion(s.osVersion); ok {
+			line = line + v.lineFields("osVersion")
+		}
 	}
 	if s.userId != "" {
 		line = line + fmt.Sprintf(",userId=%q", s.userId)
 	}
+	if s.profileSource != "" {
+		line = line + fmt.Sprintf(",profileSource=%q", s.profileSource)
+	}
+	if s.profileCache != "" {
+		line = line + fmt.Sprintf(",profileCache=%q", s.profileCache)
+	}
+	if s.refreshInterval != 0 {
+		line = line + fmt.Sprintf(",refreshInterval=%di", s.refreshInterval.Milliseconds())
+	}
+	if s.asnpId != "" {
+		line = line + fmt.Sprintf(",asnpId=%q", s.asnpId)
+	}
+	if s.uploaderVersion != "" {
+		line = line + fmt.Sprintf(",uploaderVersion=%q", s.uploaderVersion)
+		if v, ok := parseVersion(s.uploaderVersion); ok {
+			line = line + v.lineFields("uploaderVersion")
+		}
+	}
 	line = line + fmt.Sprintf(" %d", s.launchTime.UnixMilli())
 	logger.Debug("session-line-protocol", zap.Object("session", s), zap.String("line", line))
 	return line
 }
 
-func uploadLines(ep string, db string, pol string, tok string, lines []string, logger *zap.Logger) error {
+// uploadLines uploads the given lines of line protocol, retrying
+// as allowed by the sink's retry policy.
+func (s *influxSink) uploadLines(lines []string, logger *zap.Logger) error {
 	content := strings.Join(lines, "\n") + "\n"
 	logger.Debug("AdobeUsageTracker uploading line protocol",
 		zap.Strings("incoming", lines), zap.String("outgoing", content))
-	target := fmt.Sprintf("%s/write?db=%s&rp=%s&precision=ms", ep, url.QueryEscape(db), url.QueryEscape(pol))
-	body := strings.NewReader(content)
-	req, err := http.NewRequest("POST", target, body)
+	return s.retry.run(func() error { return s.postLines(content, lines, logger) }, logger)
+}
+
+// postLines makes a single attempt at uploading content (which
+// is the given lines joined together). Failures are reported
+// as an uploadError, so the caller can decide whether to retry.
+func (s *influxSink) postLines(content string, lines []string, logger *zap.Logger) error {
+	tok, err := s.tok.token()
+	if err != nil {
+		logger.Error("AdobeUsageTracker upload token error", zap.String("error", err.Error()))
+		return err
+	}
+	target := fmt.Sprintf("%s/write?db=%s&rp=%s&precision=ms", s.ep, url.QueryEscape(s.db), url.QueryEscape(s.rp))
+	req, err := http.NewRequest("POST", target, strings.NewReader(content))
 	if err != nil {
 		caddy.Log().Error("AdobeUsageTracker upload create request error", zap.String("error", err.Error()))
 		return err
 	}
 	req.Header.Set("Content-Type", "text/plain")
 	req.Header.Set("Authorization", fmt.Sprintf("Token %s", tok))
-	res, err := http.DefaultClient.Do(req)
+	res, err := s.client.Do(req)
 	if err != nil {
 		logger.Error("AdobeUsageTracker upload POST request error", zap.String("error", err.Error()))
-		return err
+		return requestError(err)
 	}
 	defer func(Body io.ReadCloser) {
 		err := Body.Close()
@@ -94,7 +248,16 @@ func uploadLines(ep string, db string, pol string, tok string, lines []string, l
 				zap.String("error", string(body)),
 			)
 		}
-		return fmt.Errorf("upload status code: %d", res.StatusCode)
+		uploadErr := responseError(res.StatusCode, res.Header, body, lines)
+		for _, n := range uploadErr.badLines {
+			if n > 0 && n <= len(lines) {
+				logger.Error("AdobeUsageTracker upload rejected line",
+					zap.Int("line-number", n),
+					zap.String("line", lines[n-1]),
+				)
+			}
+		}
+		return uploadErr
 	}
 	return nil
 }
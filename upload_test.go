@@ -35,7 +35,7 @@ var (
 
 func TestSessionLineDurationOnly(t *testing.T) {
 	logger := zaptest.NewLogger(t)
-	expected := `log-session,sessionId=testSession1 launchDuration=320010,clientIp="127.0.0.1:53450" 1716994039000`
+	expected := `log-session,sessionId=testSession1 launchDuration=320010,clientIp="127.0.0.1:53450",sessionComplete=false 1716994039000`
 
 	s := logSession{
 		sessionId:      sessionId,
@@ -51,11 +51,14 @@ func TestSessionLineDurationOnly(t *testing.T) {
 
 func TestSessionLineAllFields(t *testing.T) {
 	logger := zaptest.NewLogger(t)
-	expected := `log-session,sessionId=testSession1 launchDuration=320010,clientIp="127.0.0.1:53450"` +
+	expected := `log-session,sessionId=testSession1 launchDuration=320010,clientIp="127.0.0.1:53450",sessionComplete=false` +
 		`,appId="InDesign1",appVersion="19.2"` +
+		`,appVersionMajor=19i,appVersionMinor=2i,appVersionPatch=0i,appVersionBuild=0i` +
 		`,appLocale="en_US"` +
 		`,nglVersion="1.35.0.19"` +
+		`,nglVersionMajor=1i,nglVersionMinor=35i,nglVersionPatch=0i,nglVersionBuild=19i` +
 		`,osName="MAC",osVersion="14.3.1"` +
+		`,osVersionMajor=14i,osVersionMinor=3i,osVersionPatch=1i,osVersionBuild=0i` +
 		`,userId="9e5fa"` +
 		` 1716994039000`
 
@@ -109,7 +112,7 @@ func TestUploadSessionLine1(t *testing.T) {
 		`,userId="9e5fa"` +
 		` 1716994039000`
 	lines := []string{line1}
-	if err := uploadLines(ep, db, pol, tok, lines, logger); err != nil {
+	if err := newInfluxSink(ep, db, pol, staticToken(tok), defaultRetryPolicy).uploadLines(lines, logger); err != nil {
 		t.Errorf("uploadLines failed: %s", err.Error())
 	}
 }
@@ -118,7 +121,7 @@ func TestUploadSessionLine2(t *testing.T) {
 	logger := zaptest.NewLogger(t)
 	line2 := `log-session,sessionId=testSession1 launchDuration=640020,clientIp="127.0.0.1:53450" 1716994039000`
 	lines := []string{line2}
-	if err := uploadLines(ep, db, pol, tok, lines, logger); err != nil {
+	if err := newInfluxSink(ep, db, pol, staticToken(tok), defaultRetryPolicy).uploadLines(lines, logger); err != nil {
 		t.Errorf("uploadLines failed: %s", err.Error())
 	}
 }
@@ -134,7 +137,7 @@ func TestUploadSessionBothLines(t *testing.T) {
 		` 1716994039000`
 	line2 := `log-session,sessionId=testSession1 launchDuration=640020,clientIp="127.0.0.1:53450" 1716994039000`
 	lines := []string{line1, line2}
-	if err := uploadLines(ep, db, pol, tok, lines, logger); err != nil {
+	if err := newInfluxSink(ep, db, pol, staticToken(tok), defaultRetryPolicy).uploadLines(lines, logger); err != nil {
 		t.Errorf("uploadLines failed: %s", err.Error())
 	}
 }
@@ -151,7 +154,7 @@ func TestUploadLatestLogs(t *testing.T) {
 		}
 		sessions := parseLog(string(buffer), "127.0.0.1:53450")
 		logger := zaptest.NewLogger(t)
-		if err = sendSessions(ep, db, pol, tok, sessions, logger); err != nil {
+		if err = sendSessions(newInfluxSink(ep, db, pol, staticToken(tok), defaultRetryPolicy), sessions, logger); err != nil {
 			t.Errorf("Failed to send sessions from: %s", file)
 		}
 	}
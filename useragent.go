@@ -0,0 +1,54 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var userAgentRegex = regexp.MustCompile(`^NGL ?Client/([^\s(]+)(?:\s*\(([^/)]+)/([^)\s]+)\))?`)
+
+// An uploadAgent holds what can be learned from the User-Agent
+// of an NGL log upload, which looks like this:
+//
+//	NGL Client/1.37.0.8 (MAC/14.5.0) [...]
+//
+// The version is that of the NGL library doing the upload, which
+// is usually (but not always) the one that wrote the log.
+type uploadAgent struct {
+	nglVersion string
+	osName     string
+	osVersion  string
+}
+
+// parseUploadAgent parses an NGL upload User-Agent, which may be
+// URL-escaped. It reports false if the agent isn't an NGL client.
+func parseUploadAgent(ua string) (uploadAgent, bool) {
+	if unescaped, err := url.QueryUnescape(ua); err == nil {
+		ua = unescaped
+	}
+	match := userAgentRegex.FindStringSubmatch(strings.TrimSpace(ua))
+	if match == nil {
+		return uploadAgent{}, false
+	}
+	return uploadAgent{nglVersion: match[1], osName: match[2], osVersion: match[3]}, true
+}
+
+// apply records the uploader version in the session, and uses the
+// user agent's NGL and OS versions for any the log didn't give.
+func (u uploadAgent) apply(s *logSession) {
+	s.uploaderVersion = u.nglVersion
+	if s.nglVersion == "" {
+		s.nglVersion = u.nglVersion
+	}
+	if s.osName == "" && u.osName != "" {
+		s.osName, s.osVersion = u.osName, u.osVersion
+	}
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"bytes"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseUploadAgent(t *testing.T) {
+	for ua, expected := range map[string]uploadAgent{
+		"NGL Client/1.37.0.8 (MAC/14.5.0) [Photoshop1/25.9.0]": {"1.37.0.8", "MAC", "14.5.0"},
+		"NGL%20Client/1.35.0.19%20(WIN/10.0.19045)":            {"1.35.0.19", "WIN", "10.0.19045"},
+		"NGLClient/1.30.0.1":                                   {"1.30.0.1", "", ""},
+	} {
+		if got, ok := parseUploadAgent(ua); !ok || got != expected {
+			t.Errorf("parseUploadAgent(%q): expected %+v, got %+v (%v)", ua, expected, got, ok)
+		}
+	}
+	if _, ok := parseUploadAgent("curl/8.4.0"); ok {
+		t.Errorf("Expected a non-NGL agent not to parse")
+	}
+	agent, _ := parseUploadAgent("NGL Client/1.37.0.8 (WIN/10.0.22631)")
+	s := logSession{nglVersion: "1.35.0.19"}
+	agent.apply(&s)
+	if s.uploaderVersion != "1.37.0.8" || s.nglVersion != "1.35.0.19" || s.osName != "WIN" || s.osVersion != "10.0.22631" {
+		t.Errorf("Unexpected session after applying agent: %+v", s)
+	}
+}
+
+func TestUploadAgentFallback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dry-run.txt")
+	m := &AdobeUsageTracker{DryRun: true, DryRunFile: path, Header: "X-Forwarded-For", Position: "first"}
+	if err := m.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = m.Cleanup() }()
+	buf, err := os.ReadFile("testdata/indesign-split-session-1-2.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/ulecs/v1", bytes.NewReader(buf))
+	req.Header.Set("User-Agent", "NGL Client/1.35.0.19 (MAC/14.3.1)")
+	next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+	if err := m.ServeHTTP(httptest.NewRecorder(), req, next); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); m.stats.report().InFlightUploads > 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Upload did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	sessions := m.stats.recentSessions()
+	if len(sessions) != 1 || sessions[0].osName != "MAC" || sessions[0].nglVersion != "1.35.0.19" || sessions[0].uploaderVersion != "1.35.0.19" {
+		t.Errorf("Expected fallback fields from the user agent, got %+v", sessions)
+	}
+	line := sessionLine(sessions[0], zap.NewNop())
+	if !strings.Contains(line, `,uploaderVersion="1.35.0.19",uploaderVersionMajor=1i,uploaderVersionMinor=35i`) {
+		t.Errorf("Expected uploader fields in line, got %s", line)
+	}
+}
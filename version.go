@@ -0,0 +1,101 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A version is a parsed dotted version number, such as an Adobe
+// app version (24.2.20759.7), a macOS version (14.5.0), or an NGL
+// version (1.37.0.8). Components that are missing are zero, and
+// components after the fourth are ignored.
+type version struct {
+	major int
+	minor int
+	patch int
+	build int
+}
+
+// parseVersion parses a dotted version number. Any non-numeric
+// suffix of a component (as in 1.37.0.8b) is ignored, but the
+// major version must start with a digit.
+func parseVersion(s string) (version, bool) {
+	parts := strings.Split(strings.TrimSpace(s), ".")
+	if parts[0] == "" || parts[0][0] < '0' || parts[0][0] > '9' {
+		return version{}, false
+	}
+	var v version
+	for i, field := range []*int{&v.major, &v.minor, &v.patch, &v.build} {
+		if i < len(parts) {
+			*field = leadingInt(parts[i])
+		}
+	}
+	return v, true
+}
+
+// compare returns -1, 0, or 1 as v is older than, the same
+// as, or newer than w.
+func (v version) compare(w version) int {
+	for _, pair := range [][2]int{{v.major, w.major}, {v.minor, w.minor}, {v.patch, w.patch}, {v.build, w.build}} {
+		if pair[0] != pair[1] {
+			if pair[0] < pair[1] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// lineFields returns line protocol integer fields for the
+// components of v, named with the given prefix.
+func (v version) lineFields(prefix string) string {
+	return fmt.Sprintf(",%sMajor=%di,%sMinor=%di,%sPatch=%di,%sBuild=%di",
+		prefix, v.major, prefix, v.minor, prefix, v.patch, prefix, v.build)
+}
+
+// validVersion reports whether v is a dotted version number
+// with all-numeric components.
+func validVersion(v string) bool {
+	for _, part := range strings.Split(v, ".") {
+		if _, err := strconv.Atoi(part); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// compareVersions compares two dotted version numbers component
+// by component, treating missing components as zero, and returns
+// -1, 0, or 1. Unparseable versions are older than all others.
+func compareVersions(a, b string) int {
+	va, okA := parseVersion(a)
+	vb, okB := parseVersion(b)
+	switch {
+	case okA && okB:
+		return va.compare(vb)
+	case okA:
+		return 1
+	case okB:
+		return -1
+	}
+	return 0
+}
+
+// leadingInt returns the integer value of the leading digits of s.
+func leadingInt(s string) int {
+	end := 0
+	for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+		end++
+	}
+	n, _ := strconv.Atoi(s[:end])
+	return n
+}
@@ -0,0 +1,56 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseVersion(t *testing.T) {
+	for s, expected := range map[string]version{
+		"24.2.20759.7": {24, 2, 20759, 7},
+		"14.5.0":       {14, 5, 0, 0},
+		"1.37.0.8":     {1, 37, 0, 8},
+		"19.4":         {19, 4, 0, 0},
+		"10.0.19045.1": {10, 0, 19045, 1},
+		"25":           {25, 0, 0, 0},
+		"1.2.3.4.5":    {1, 2, 3, 4},
+		"1.37.0.8b":    {1, 37, 0, 8},
+	} {
+		if v, ok := parseVersion(s); !ok || v != expected {
+			t.Errorf("parseVersion(%q): expected %+v, got %+v (%v)", s, expected, v, ok)
+		}
+	}
+	for _, s := range []string{"", "beta", ".1", "v1.2"} {
+		if _, ok := parseVersion(s); ok {
+			t.Errorf("parseVersion(%q): expected failure", s)
+		}
+	}
+	if got := compareVersions("beta", "1.0"); got != -1 {
+		t.Errorf("Expected unparseable versions to be oldest, got %d", got)
+	}
+}
+
+func TestVersionLineFields(t *testing.T) {
+	v, _ := parseVersion("24.2.20759.7")
+	expected := ",appVersionMajor=24i,appVersionMinor=2i,appVersionPatch=20759i,appVersionBuild=7i"
+	if got := v.lineFields("appVersion"); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
+
+func TestReportLatestVersion(t *testing.T) {
+	s1 := reportSession("s1", "alice", "Photoshop1", 2, time.Hour)
+	s1.appVersion = "25.10.0"
+	s2 := reportSession("s2", "alice", "Photoshop1", 1, time.Hour)
+	s2.appVersion = "25.9.1"
+	report := buildUsageReport([]logSession{s1, s2}, reportParams{until: reportEnd, window: 30 * 24 * time.Hour, inactiveDays: 30})
+	if got := report.Users[0].Apps[0].LatestVersion; got != "25.10.0" {
+		t.Errorf("Expected latest version 25.10.0, got %q", got)
+	}
+}